@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// apiServer lets test harnesses control the recordings over HTTP instead of sending signals:
+// POST /start, POST /checkpoint?name=..., POST /stop and GET /diff
+type apiServer struct {
+	context   *context
+	useOplog  bool
+	lock      sync.Mutex
+	recording *recording
+	prefix    string
+}
+
+// diffSummary is the answer of the API, it tells how many documents have been changed per collection
+type diffSummary struct {
+	Recording   bool                `json:"recording"`
+	FileOutput  string              `json:"fileOutput,omitempty"`
+	Collections []collectionSummary `json:"collections"`
+}
+
+type collectionSummary struct {
+	Namespace string `json:"namespace"`
+	Added     int    `json:"added"`
+	Modified  int    `json:"modified"`
+	Removed   int    `json:"removed"`
+}
+
+// apiError is answered with its status code instead of the usual 500
+type apiError struct {
+	status  int
+	message string
+}
+
+func (err apiError) Error() string {
+	return err.message
+}
+
+// outputName limits the names of the recordings and of the checkpoints, which become parts of the file names,
+// so that a request can't make the files be written outside of the directory given via -fileOutput
+var outputName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// serveAPI answers the API requests until Ctrl+C, a recording still in progress is then stopped
+func serveAPI(ctx *context, useOplog bool, address string) {
+	server := &apiServer{context: ctx, useOplog: useOplog}
+	go func() {
+		log.Fatalln("Could not serve the API", http.ListenAndServe(address, server.handler()))
+	}()
+	fmt.Println(blueFormat("Listening for API requests on ") + redFormat(address) + blueFormat(", send SIGINT (") + redFormat("Ctrl+C") + blueFormat(") to quit"))
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt)
+	<-signalChannel
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.recording != nil {
+		_, _ = server.stop(&http.Request{})
+	}
+}
+
+func (server *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", server.handle(http.MethodPost, server.start))
+	mux.HandleFunc("/checkpoint", server.handle(http.MethodPost, server.checkpoint))
+	mux.HandleFunc("/stop", server.handle(http.MethodPost, server.stop))
+	mux.HandleFunc("/diff", server.handle(http.MethodGet, server.diff))
+	return mux
+}
+
+// handle serializes the requests and writes the answers as JSON
+func (server *apiServer) handle(method string, handler func(request *http.Request) (*diffSummary, error)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		var answer interface{}
+		status := http.StatusOK
+		if request.Method != method {
+			status, answer = http.StatusMethodNotAllowed, map[string]string{"error": method + " expected"}
+		} else {
+			server.lock.Lock()
+			summary, err := handler(request)
+			server.lock.Unlock()
+			answer = summary
+			if apiErr, ok := err.(apiError); ok {
+				status, answer = apiErr.status, map[string]string{"error": apiErr.message}
+			} else if err != nil {
+				status, answer = http.StatusInternalServerError, map[string]string{"error": err.Error()}
+			}
+		}
+		writer.WriteHeader(status)
+		if err := json.NewEncoder(writer).Encode(answer); err != nil {
+			fmt.Println("Could not write API answer", err)
+		}
+	}
+}
+
+func (server *apiServer) start(request *http.Request) (*diffSummary, error) {
+	if server.recording != nil {
+		return nil, apiError{http.StatusConflict, "recording is already in progress"}
+	}
+	server.prefix = server.context.prefix
+	if name := request.FormValue("fileOutput"); name != "" {
+		if !outputName.MatchString(name) {
+			return nil, apiError{http.StatusBadRequest, "fileOutput must consist of letters, digits, - and _"}
+		}
+		server.prefix = filepath.Join(filepath.Dir(server.context.prefix), name)
+	}
+	server.recording = server.context.startRecording(server.useOplog)
+	return &diffSummary{Recording: true, Collections: []collectionSummary{}}, nil
+}
+
+// checkpoint writes the scripts for the changes done since the start or the previous checkpoint,
+// the name of the checkpoint is appended to the prefix of the files
+func (server *apiServer) checkpoint(request *http.Request) (*diffSummary, error) {
+	name := request.FormValue("name")
+	if !outputName.MatchString(name) {
+		return nil, apiError{http.StatusBadRequest, "checkpoint name must consist of letters, digits, - and _"}
+	}
+	if server.recording == nil {
+		return nil, apiError{http.StatusConflict, "no recording in progress"}
+	}
+	return server.output(server.recording.changes(true), server.prefix+"_"+name), nil
+}
+
+func (server *apiServer) stop(request *http.Request) (*diffSummary, error) {
+	if server.recording == nil {
+		return nil, apiError{http.StatusConflict, "no recording in progress"}
+	}
+	changes := server.recording.stop()
+	server.recording = nil
+	return server.output(changes, server.prefix), nil
+}
+
+// diff tells what has been changed so far, without writing any scripts. Unless the oplog is tailed the
+// DB is scanned again for it, so it takes as long as stopping the recording and blocks the other requests
+func (server *apiServer) diff(request *http.Request) (*diffSummary, error) {
+	if server.recording == nil {
+		return nil, apiError{http.StatusConflict, "no recording in progress"}
+	}
+	summary := summarize(server.recording.changes(false))
+	summary.Recording = true
+	return summary, nil
+}
+
+func (server *apiServer) output(changes data, prefix string) *diffSummary {
+	outputChanges(server.context.withPrefix(prefix), changes)
+	summary := summarize(changes)
+	summary.Recording = server.recording != nil
+	if len(changes) > 0 {
+		summary.FileOutput = prefix
+	}
+	return summary
+}
+
+func summarize(changes data) *diffSummary {
+	summary := &diffSummary{Collections: []collectionSummary{}}
+	for _, namespace := range changes.namespaces() {
+		ids := changes[namespace]
+		summary.Collections = append(summary.Collections, collectionSummary{
+			Namespace: namespace,
+			Added:     len(ids.Ids),
+			Modified:  len(ids.Modified),
+			Removed:   len(ids.Removed),
+		})
+	}
+	return summary
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIRejectsInvalidRequests(t *testing.T) {
+	server := httptest.NewServer((&apiServer{context: &context{}}).handler())
+	defer server.Close()
+
+	expectations := []struct {
+		method string
+		path   string
+		status int
+		error  string
+	}{
+		{http.MethodGet, "/start", http.StatusMethodNotAllowed, "POST expected"},
+		{http.MethodPost, "/diff", http.StatusMethodNotAllowed, "GET expected"},
+		{http.MethodPost, "/stop", http.StatusConflict, "no recording in progress"},
+		{http.MethodGet, "/diff", http.StatusConflict, "no recording in progress"},
+		{http.MethodPost, "/checkpoint?name=signup", http.StatusConflict, "no recording in progress"},
+		{http.MethodPost, "/checkpoint?name=../signup", http.StatusBadRequest, "checkpoint name"},
+		{http.MethodPost, "/start?fileOutput=../checkout", http.StatusBadRequest, "fileOutput must"},
+		{http.MethodPost, "/start?fileOutput=%2Ftmp%2Fcheckout", http.StatusBadRequest, "fileOutput must"},
+	}
+	for _, expectation := range expectations {
+		request, _ := http.NewRequest(expectation.method, server.URL+expectation.path, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if response.StatusCode != expectation.status || !strings.Contains(string(body), expectation.error) {
+			t.Errorf("%s %s: expected %d with %q, but got %d with %s", expectation.method, expectation.path, expectation.status, expectation.error, response.StatusCode, body)
+		}
+	}
+}
+
+func TestSummaryOfChanges(t *testing.T) {
+	changes := data{}
+	changes.collectionChanges("test.b").Ids["foo"] = true
+	changes.collectionChanges("test.a").Modified["bar"] = true
+	changes.collectionChanges("test.a").Removed["baz"] = true
+
+	summary := summarize(changes)
+	expected := []collectionSummary{{Namespace: "test.a", Modified: 1, Removed: 1}, {Namespace: "test.b", Added: 1}}
+	if len(summary.Collections) != 2 || summary.Collections[0] != expected[0] || summary.Collections[1] != expected[1] {
+		t.Error("Expected summary", expected, "but got", summary.Collections)
+	}
+}
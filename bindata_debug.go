@@ -1,10 +1,14 @@
 // Code generated by go-bindata.
 // sources:
+// data/template_chapters_bash
+// data/template_chapters_bat
 // data/template_clean_bash
 // data/template_clean_bat
 // data/template_js
 // data/template_replay_bash
 // data/template_replay_bat
+// data/template_replay_js
+// data/template_report_html
 // DO NOT EDIT!
 
 package main
@@ -31,6 +35,42 @@ type asset struct {
 	info  os.FileInfo
 }
 
+// dataTemplate_chapters_bash reads file data from disk. It returns an error on failure.
+func dataTemplate_chapters_bash() (*asset, error) {
+	path := "/opt/go/src/github.com/milanaleksic/mongodiff/data/template_chapters_bash"
+	name := "data/template_chapters_bash"
+	bytes, err := bindataRead(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading asset info %s at %s: %v", name, path, err)
+	}
+
+	a := &asset{bytes: bytes, info: fi}
+	return a, err
+}
+
+// dataTemplate_chapters_bat reads file data from disk. It returns an error on failure.
+func dataTemplate_chapters_bat() (*asset, error) {
+	path := "/opt/go/src/github.com/milanaleksic/mongodiff/data/template_chapters_bat"
+	name := "data/template_chapters_bat"
+	bytes, err := bindataRead(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading asset info %s at %s: %v", name, path, err)
+	}
+
+	a := &asset{bytes: bytes, info: fi}
+	return a, err
+}
+
 // dataTemplate_clean_bash reads file data from disk. It returns an error on failure.
 func dataTemplate_clean_bash() (*asset, error) {
 	path := "/opt/go/src/github.com/milanaleksic/mongodiff/data/template_clean_bash"
@@ -121,6 +161,42 @@ func dataTemplate_replay_bat() (*asset, error) {
 	return a, err
 }
 
+// dataTemplate_replay_js reads file data from disk. It returns an error on failure.
+func dataTemplate_replay_js() (*asset, error) {
+	path := "/opt/go/src/github.com/milanaleksic/mongodiff/data/template_replay_js"
+	name := "data/template_replay_js"
+	bytes, err := bindataRead(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading asset info %s at %s: %v", name, path, err)
+	}
+
+	a := &asset{bytes: bytes, info: fi}
+	return a, err
+}
+
+// dataTemplate_report_html reads file data from disk. It returns an error on failure.
+func dataTemplate_report_html() (*asset, error) {
+	path := "/opt/go/src/github.com/milanaleksic/mongodiff/data/template_report_html"
+	name := "data/template_report_html"
+	bytes, err := bindataRead(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading asset info %s at %s: %v", name, path, err)
+	}
+
+	a := &asset{bytes: bytes, info: fi}
+	return a, err
+}
+
 // Asset loads and returns the asset for the given name.
 // It returns an error if the asset could not be found or
 // could not be loaded.
@@ -173,11 +249,15 @@ func AssetNames() []string {
 
 // _bindata is a table, holding each asset generator, mapped to its name.
 var _bindata = map[string]func() (*asset, error){
+	"data/template_chapters_bash": dataTemplate_chapters_bash,
+	"data/template_chapters_bat": dataTemplate_chapters_bat,
 	"data/template_clean_bash": dataTemplate_clean_bash,
 	"data/template_clean_bat": dataTemplate_clean_bat,
 	"data/template_js": dataTemplate_js,
 	"data/template_replay_bash": dataTemplate_replay_bash,
 	"data/template_replay_bat": dataTemplate_replay_bat,
+	"data/template_replay_js": dataTemplate_replay_js,
+	"data/template_report_html": dataTemplate_report_html,
 }
 
 // AssetDir returns the file names below a certain
@@ -221,11 +301,15 @@ type bintree struct {
 }
 var _bintree = &bintree{nil, map[string]*bintree{
 	"data": &bintree{nil, map[string]*bintree{
+		"template_chapters_bash": &bintree{dataTemplate_chapters_bash, map[string]*bintree{}},
+		"template_chapters_bat": &bintree{dataTemplate_chapters_bat, map[string]*bintree{}},
 		"template_clean_bash": &bintree{dataTemplate_clean_bash, map[string]*bintree{}},
 		"template_clean_bat": &bintree{dataTemplate_clean_bat, map[string]*bintree{}},
 		"template_js": &bintree{dataTemplate_js, map[string]*bintree{}},
 		"template_replay_bash": &bintree{dataTemplate_replay_bash, map[string]*bintree{}},
 		"template_replay_bat": &bintree{dataTemplate_replay_bat, map[string]*bintree{}},
+		"template_replay_js": &bintree{dataTemplate_replay_js, map[string]*bintree{}},
+		"template_report_html": &bintree{dataTemplate_report_html, map[string]*bintree{}},
 	}},
 }}
 
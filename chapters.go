@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+)
+
+// chapter is a part of the recording which can be replayed on its own, its changes are relative to the previous chapter
+type chapter struct {
+	Number   int
+	Name     string
+	Filename string
+}
+
+type chaptersData struct {
+	Filename         string
+	LastChapter      int
+	Chapters         []chapter
+	ReversedChapters []chapter
+}
+
+var chaptersConfigurations = []templateConfiguration{
+	{"{{.Filename}}_chapters.bat", "data/template_chapters_bat", 0600},
+	{"{{.Filename}}_chapters.sh", "data/template_chapters_bash", 0700},
+}
+
+var invalidChapterName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// recordChapters closes a chapter and opens the next one whenever Enter is pressed, the text typed
+// before names the chapter. Ctrl+C closes the last chapter and ends the recording
+func recordChapters(ctx *context, useOplog bool) {
+	recording := ctx.startRecording(useOplog)
+
+	lines := inputLines()
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt)
+	defer signal.Stop(signalChannel)
+
+	var chapters []chapter
+	for number := 1; ; number++ {
+		fmt.Println(blueFormat(fmt.Sprintf("Recording chapter %d: press ", number)) + redFormat("Enter") +
+			blueFormat(" to close it (type its name before, if you wish), send SIGINT (") + redFormat("Ctrl+C") + blueFormat(") to close the last chapter"))
+		select {
+		case name := <-lines:
+			chapters = ctx.outputChapter(chapters, number, name, recording.changes(true))
+		case c := <-signalChannel:
+			fmt.Println(blueFormat("Signal received: ") + redFormat(c.String()))
+			chapters = ctx.outputChapter(chapters, number, "", recording.stop())
+			writeChaptersScripts(ctx.prefix, chapters)
+			return
+		}
+	}
+}
+
+// outputChapter writes the scripts of the chapter, the chapters without changes are left out
+func (context *context) outputChapter(chapters []chapter, number int, name string, changes data) []chapter {
+	name = chapterName(name)
+	current := chapter{Number: number, Name: name, Filename: fmt.Sprintf("%s_chapter%d", context.prefix, number)}
+	if name != "" {
+		current.Filename += "_" + name
+	}
+	fmt.Println(blueFormat(fmt.Sprintf("Chapter %d closed", number)))
+	if len(changes) == 0 {
+		fmt.Println(redFormat("No changes detected!"))
+		return chapters
+	}
+	if len(outputChanges(context.withPrefix(current.Filename), changes)) == 0 {
+		return chapters
+	}
+	return append(chapters, current)
+}
+
+// chapterName makes the typed name usable in file names
+func chapterName(typed string) string {
+	return strings.Trim(invalidChapterName.ReplaceAllString(strings.TrimSpace(typed), "_"), "_")
+}
+
+// writeChaptersScripts writes the scripts which clean the changes of all the chapters
+// and then replay them up to the chapter given as the second argument
+func writeChaptersScripts(prefix string, chapters []chapter) {
+	if len(chapters) == 0 {
+		return
+	}
+	data := chaptersData{
+		Filename:    prefix,
+		LastChapter: chapters[len(chapters)-1].Number,
+		Chapters:    chapters,
+	}
+	for i := len(chapters) - 1; i >= 0; i-- {
+		data.ReversedChapters = append(data.ReversedChapters, chapters[i])
+	}
+	writeTemplates(chaptersConfigurations, data)
+	fmt.Println(blueFormat("Chapters can be replayed with ") + redFormat(prefix+"_chapters.sh") + blueFormat(" or ") + redFormat(prefix+"_chapters.bat"))
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestChaptersWithoutChangesAreLeftOut(t *testing.T) {
+	ctx := &context{prefix: "setup"}
+	chapters := []chapter{{Number: 1, Filename: "setup_chapter1"}}
+
+	chapters = ctx.outputChapter(chapters, 2, " customer signs up! ", data{})
+	if len(chapters) != 1 {
+		t.Error("Expected chapter without changes to be left out, but got", chapters)
+	}
+}
+
+func TestChapterNames(t *testing.T) {
+	expectations := map[string]string{
+		"":                     "",
+		"signup":               "signup",
+		" customer signs up! ": "customer_signs_up",
+		"order/ships":          "order_ships",
+	}
+	for typed, expected := range expectations {
+		if name := chapterName(typed); name != expected {
+			t.Errorf("Expected name %q for %q, but got %q", expected, typed, name)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/mongodb/mongo-tools/common/bsonutil"
 	mgo "gopkg.in/mgo.v2"
@@ -16,50 +21,120 @@ import (
 )
 
 type collectionItem struct {
-	ID interface{} `bson:"_id"`
+	ID bson.Raw `bson:"_id"`
 }
 
+func (item collectionItem) key() interface{} {
+	return idKey(item.ID)
+}
+
+// collectionIds holds, in a snapshot, all the known ids together with the
+// fingerprints of their documents. In a diff Ids holds the added documents,
+// Modified the ones whose content has changed and Removed the ones that have
+// disappeared; Documents keeps the original contents of modified and removed
+// documents, since they can't be fetched anymore from the DB.
 type collectionIds struct {
-	Ids map[interface{}]bool
+	Ids       map[interface{}]bool
+	Hashes    map[interface{}]string
+	Modified  map[interface{}]bool
+	Removed   map[interface{}]bool
+	Documents map[interface{}][]byte
+	// documentBytes is the size of the Documents kept in memory, see idStore
+	documentBytes int
+	// Runs are the files to which the ids have been moved by idStore when there were too many of them
+	Runs []string
+	// Metadata describes the indexes and options of the collection in a snapshot, while
+	// MetadataChanges tells in a diff how they have been changed
+	Metadata        *collectionMetadata
+	MetadataChanges *metadataChanges
+}
+
+func newCollectionIds() collectionIds {
+	return collectionIds{
+		Ids:       make(map[interface{}]bool, 0),
+		Hashes:    make(map[interface{}]string, 0),
+		Modified:  make(map[interface{}]bool, 0),
+		Removed:   make(map[interface{}]bool, 0),
+		Documents: make(map[interface{}][]byte, 0),
+	}
 }
 
+// data holds the collections by their namespace, i.e. "db.collection"
 type data map[string]collectionIds
 
+// systemDatabases are never recorded when all the databases are being recorded
+var systemDatabases = map[string]bool{"admin": true, "local": true, "config": true}
+
+func splitNamespace(namespace string) (dbName string, collectionName string) {
+	parts := strings.SplitN(namespace, ".", 2)
+	if len(parts) < 2 {
+		return "", namespace
+	}
+	return parts[0], parts[1]
+}
+
 type context struct {
-	session  *mgo.Session
-	db       *mgo.Database
-	host     string
-	dbName   string
-	excludes string
-	prefix   string
-	username string
-	password string
+	session         *mgo.Session
+	host            string
+	uri             string
+	dbName          string
+	dbNames         []string
+	allDbs          bool
+	excludes        string
+	filter          collectionFilter
+	queries         collectionQueries
+	idsOnly         bool
+	scanWorkers     int
+	store           *idStore
+	scans           []scanTiming
+	report          string
+	reportFile      string
+	review          bool
+	prefix          string
+	username        string
+	password        string
 	copyCredentials bool
+	// startingPoints fingerprint the collections before the recording, they are taken before
+	// the changes are reviewed since the left out changes still belong to the starting point
+	startingPoints map[string]*startingPoint
 }
 
+// checkMongoUp succeeds as soon as one of the servers can be reached
 func (context *context) checkMongoUp() (err error) {
-	target := context.host
-	if !strings.Contains(target, ":") {
-		target = target + ":27017"
+	targets := []string{context.host}
+	if context.uri != "" {
+		info, err := parseConnectionURI(context.uri)
+		if err != nil {
+			return err
+		}
+		targets = info.Addrs
 	}
-	fmt.Printf("Checking if Mongo is up... %s\n", target)
-	conn, err := net.Dial("tcp", target)
-	if err != nil {
-		return err
+	for _, target := range targets {
+		if !strings.Contains(target, ":") {
+			target = target + ":27017"
+		}
+		fmt.Printf("Checking if Mongo is up... %s\n", target)
+		var conn net.Conn
+		conn, err = net.Dial("tcp", target)
+		if err == nil {
+			return conn.Close()
+		}
 	}
-	defer func() {
-		_ = conn.Close()
-	}()
 	return
 }
 
 func (context *context) connect() {
 	var err error
-	info, err := mgo.ParseURL(context.host)
+	var info *mgo.DialInfo
+	if context.uri != "" {
+		info, err = parseConnectionURI(context.uri)
+	} else {
+		info, err = mgo.ParseURL(context.host)
+	}
 	if err != nil {
 		panic(err)
 	}
-	info.Timeout = 5*time.Second
+	info.Timeout = 5 * time.Second
 	if context.username != "" && context.password != "" {
 		info.Username = context.username
 		info.Password = context.password
@@ -70,93 +145,312 @@ func (context *context) connect() {
 		panic(err)
 	}
 	context.session.SetMode(mgo.Monotonic, true)
-	context.db = context.session.DB(context.dbName)
+}
+
+// databases gives back the names of all the DBs being monitored, dbName is the first one of them
+func (context *context) databases() []string {
+	if !context.allDbs {
+		if len(context.dbNames) == 0 {
+			return []string{context.dbName}
+		}
+		return context.dbNames
+	}
+	names, err := context.session.DatabaseNames()
+	if err != nil {
+		log.Fatal("Could not fetch database names (?)", err)
+	}
+	var databases []string
+	for _, name := range names {
+		if !systemDatabases[name] {
+			databases = append(databases, name)
+		}
+	}
+	return databases
+}
+
+func (context *context) collection(namespace string) *mgo.Collection {
+	dbName, collectionName := splitNamespace(namespace)
+	return context.session.DB(dbName).C(collectionName)
+}
+
+// withPrefix gives back a copy of the context which writes the files with another prefix,
+// the scans done so far are moved to the copy so that they are reported only once
+func (context *context) withPrefix(prefix string) *context {
+	copied := *context
+	copied.prefix = prefix
+	context.scans = nil
+	return &copied
 }
 
 func (context *context) close() {
 	context.session.Close()
+	context.store.close()
 }
 
-func (context *context) collectData() (collectedData data) {
-	var maxLength = 0
-	defer func() {
-		fmt.Printf("\rScanning completed!%*s\n", maxLength + 1, "")
-	}()
+// collectData takes a snapshot of all the ids in the DB. When withDocuments is set the
+// documents themselves are kept as well, so that the ones which get modified or removed
+// can be restored later. Collections are scanned concurrently by scanWorkers workers
+func (context *context) collectData(withDocuments bool) (collectedData data) {
+	var namespaces []string
+	var skipped []string
+	infos := make(map[string]collectionInfo)
+	for _, dbName := range context.databases() {
+		for _, info := range listCollections(context.session, dbName) {
+			if strings.HasPrefix(info.Name, "system.") {
+				continue
+			}
+			namespace := dbName + "." + info.Name
+			if reason := context.skipReason(namespace); reason != "" {
+				skipped = append(skipped, fmt.Sprintf("%s (%s)", namespace, reason))
+				continue
+			}
+			namespaces = append(namespaces, namespace)
+			infos[namespace] = info
+		}
+	}
 
-	collections, err := context.db.CollectionNames()
-	if err != nil {
-		log.Fatal("Could not fetch collection names (?)", err)
+	workers := context.scanWorkers
+	if workers < 1 {
+		workers = 1
 	}
+	total := scanStats{namespace: "all collections"}
+	started := time.Now()
 	collectedData = make(data)
-
-	outer:
-	for _, collection := range collections {
-		if strings.HasPrefix(collection, "system.") {
-			continue
-		}
-		if ln := len(collection); ln > maxLength {
-			maxLength = ln
-		}
-		fmt.Printf("\r%sScanning collection %s", resetFormat, redFormat(collection))
-		for _, exclude := range strings.Split(context.excludes, ",") {
-			if collection == exclude {
-				continue outer
+	namespacesToScan := make(chan string)
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			session := context.session.Copy()
+			defer session.Close()
+			for namespace := range namespacesToScan {
+				ids, stats := newCollectionIds(), scanStats{namespace: namespace}
+				// views are recorded only by their metadata, their documents belong to other collections
+				if !infos[namespace].isView() {
+					ids, stats = context.collectCollection(session, namespace, withDocuments)
+				}
+				ids.Metadata = collectMetadata(session, namespace, infos[namespace])
+				lock.Lock()
+				collectedData[namespace] = ids
+				total.documents += stats.documents
+				total.bytes += stats.bytes
+				fmt.Println("\t", blueFormat("Scanned ")+stats.String())
+				lock.Unlock()
 			}
-		}
-		ids := make(map[interface{}]bool, 0)
-		iter := context.db.C(collection).Find(nil).Iter()
+		}()
+	}
+	for _, namespace := range namespaces {
+		namespacesToScan <- namespace
+	}
+	close(namespacesToScan)
+	wait.Wait()
+	total.duration = time.Since(started)
+	context.scans = append(context.scans, scanTiming{
+		Name:       fmt.Sprintf("scan %d", len(context.scans)+1),
+		Started:    started,
+		DurationMs: int64(total.duration / time.Millisecond),
+		Documents:  total.documents,
+	})
 
-		collItem := collectionItem{}
-		for iter.Next(&collItem) {
-			// fmt.Printf("Result: %v\n", collItem.Id)
-			ids[collItem.ID] = true
-		}
-		if err := iter.Close(); err != nil {
-			log.Fatal("Could not close iterator", err)
+	fmt.Println("Scanning completed!", total.String())
+	for _, collection := range skipped {
+		fmt.Println("\t", blueFormat("Skipped ")+collection)
+	}
+	return
+}
+
+// scanStats tells how fast a collection has been scanned
+type scanStats struct {
+	namespace string
+	documents int
+	bytes     int
+	duration  time.Duration
+}
+
+func (stats scanStats) String() string {
+	seconds := stats.duration.Seconds()
+	if seconds == 0 {
+		seconds = math.SmallestNonzeroFloat64
+	}
+	megabytes := float64(stats.bytes) / (1024 * 1024)
+	return fmt.Sprintf("%s: %d documents, %.1f MB in %v (%.0f documents/s, %.1f MB/s)",
+		stats.namespace, stats.documents, megabytes, stats.duration.Round(time.Millisecond),
+		float64(stats.documents)/seconds, megabytes/seconds)
+}
+
+// collectCollection reads the ids and the fingerprints of the documents, or only the ids
+// when idsOnly is set, in which case modified documents can't be detected
+func (context *context) collectCollection(session *mgo.Session, namespace string, withDocuments bool) (collectionIds, scanStats) {
+	ids := newCollectionIds()
+	stats := scanStats{namespace: namespace}
+	started := time.Now()
+	dbName, collectionName := splitNamespace(namespace)
+	query := session.DB(dbName).C(collectionName).Find(context.queries.queryFor(namespace))
+	if context.idsOnly {
+		query = query.Select(bson.M{"_id": 1})
+	}
+	iter := query.Iter()
+
+	raw := bson.Raw{}
+	for iter.Next(&raw) {
+		context.addDocument(&ids, raw, withDocuments)
+		stats.documents++
+		stats.bytes += len(raw.Data)
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatal("Could not close iterator", err)
+	}
+	context.store.finish(&ids)
+	stats.duration = time.Since(started)
+	return ids, stats
+}
+
+// addDocument keeps the id of the scanned document, together with its fingerprint and (when asked for) its
+// contents unless only the ids are scanned, and moves the ids to disk once there are too many of them
+func (context *context) addDocument(ids *collectionIds, raw bson.Raw, withDocuments bool) {
+	collItem := collectionItem{}
+	if err := raw.Unmarshal(&collItem); err != nil {
+		log.Fatal("Could not read document id", err)
+	}
+	id := collItem.key()
+	ids.Ids[id] = true
+	if !context.idsOnly {
+		ids.Hashes[id] = fingerprint(raw.Data)
+		if withDocuments {
+			ids.keepDocument(id, append([]byte(nil), raw.Data...))
 		}
+	}
+	context.store.spillIfNeeded(ids)
+}
+
+// isExcluded checks the namespace against the excludes, which can name the collection alone or
+// together with its DB, and against the include and exclude patterns
+func (context *context) isExcluded(namespace string) bool {
+	return context.skipReason(namespace) != ""
+}
 
-		collectedData[collection] = collectionIds{
-			Ids: ids,
+// skipReason explains why the collection isn't recorded, it is empty for the recorded ones
+func (context *context) skipReason(namespace string) string {
+	_, collection := splitNamespace(namespace)
+	for _, exclude := range strings.Split(context.excludes, ",") {
+		if collection == exclude || namespace == exclude {
+			return "excluded by name"
 		}
 	}
+	return context.filter.skipReason(namespace)
+}
+
+// fingerprint is a compact digest of the raw BSON document, the server keeps
+// field order stable so an unchanged document always gives the same value
+func fingerprint(document []byte) string {
+	sum := md5.Sum(document)
+	return string(sum[:])
+}
+
+// namespaces gives back the namespaces in alphabetical order, so that all the collections of a
+// DB come one after another
+func (diff data) namespaces() (namespaces []string) {
+	for namespace := range diff {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
 	return
 }
 
+// collectionChanges gives back the changes already known for the collection,
+// creating them when the collection is seen for the first time
+func (diff data) collectionChanges(collectionName string) collectionIds {
+	changes, ok := diff[collectionName]
+	if !ok {
+		changes = newCollectionIds()
+		diff[collectionName] = changes
+	}
+	return changes
+}
+
 func (context *context) diffData(before data, after data) data {
 	changes := data{}
 	for collectionName, knownIds := range before {
 		newItems, ok := after[collectionName]
 		if !ok {
-			changes[collectionName] = knownIds
+			// the collection has been dropped, all of its documents are seen as removed so that the originals are kept
+			newItems = newCollectionIds()
+			changes.addMetadataChanges(collectionName, droppedCollection(knownIds.Metadata))
+		} else {
+			changes.addMetadataChanges(collectionName, diffMetadata(knownIds.Metadata, newItems.Metadata))
+		}
+		if len(knownIds.Runs) > 0 || len(newItems.Runs) > 0 {
+			changes.diffSorted(collectionName, knownIds, newItems)
 			continue
 		}
 		for maybeANewID := range newItems.Ids {
 			if _, ok := knownIds.Ids[maybeANewID]; !ok {
-				if _, ok := changes[collectionName]; !ok {
-					changes[collectionName] = collectionIds{
-						Ids: make(map[interface{}]bool, 0),
-					}
-				}
-				changes[collectionName].Ids[maybeANewID] = true
+				changes.collectionChanges(collectionName).Ids[maybeANewID] = true
+			} else if hashesDiffer(knownIds.Hashes[maybeANewID], newItems.Hashes[maybeANewID]) {
+				changes.collectionChanges(collectionName).Modified[maybeANewID] = true
+				changes.keepOriginal(collectionName, maybeANewID, knownIds)
+			}
+		}
+		for maybeRemovedID := range knownIds.Ids {
+			if _, ok := newItems.Ids[maybeRemovedID]; !ok {
+				changes.collectionChanges(collectionName).Removed[maybeRemovedID] = true
+				changes.keepOriginal(collectionName, maybeRemovedID, knownIds)
 			}
 		}
 	}
 	for collectionName, knownIds := range after {
-		_, ok := before[collectionName]
-		if !ok {
-			changes[collectionName] = knownIds
+		if _, ok := before[collectionName]; ok {
+			continue
+		}
+		if len(knownIds.Runs) > 0 {
+			changes.diffSorted(collectionName, newCollectionIds(), knownIds)
+		} else {
+			for id := range knownIds.Ids {
+				changes.collectionChanges(collectionName).Ids[id] = true
+			}
 		}
+		changes.addMetadataChanges(collectionName, createdCollection(knownIds.Metadata))
 	}
 	// fmt.Printf("Before: %v\nAfter: %v\nDiff: %v\n", before, after, changes)
 	return changes
 }
 
-func (context *context) presentDiffData(diffData data) {
+// hashesDiffer compares the fingerprints, which are missing when only the ids have been scanned
+func hashesDiffer(before string, after string) bool {
+	return before != "" && after != "" && before != after
+}
+
+func (diff data) keepOriginal(collectionName string, id interface{}, before collectionIds) {
+	if document, ok := before.Documents[id]; ok {
+		diff.collectionChanges(collectionName).Documents[id] = document
+	}
+}
+
+func (context *context) presentDiffData(diffData data, fields fieldChanges) {
 	fmt.Println(redFormat("All changed data: "))
 	for collectionName, ids := range diffData {
 		fmt.Println("\t", blueFormat(collectionName))
 		for id := range ids.Ids {
-			fmt.Println("\t\t", greenFormat(fmt.Sprintf("%v", id)))
+			fmt.Println("\t\t", greenFormat(fmt.Sprintf("+ %v", idValue(id))))
+		}
+		for id := range ids.Modified {
+			fmt.Println("\t\t", blueFormat(fmt.Sprintf("~ %v", idValue(id))))
+			for _, field := range fields[collectionName][id] {
+				fmt.Println("\t\t\t", field.String())
+			}
+		}
+		for id := range ids.Removed {
+			fmt.Println("\t\t", redFormat(fmt.Sprintf("- %v", idValue(id))))
+		}
+		if ids.MetadataChanges != nil {
+			for _, description := range ids.MetadataChanges.descriptions() {
+				fmt.Println("\t\t", description)
+			}
+			if fixed := ids.MetadataChanges.fixedOptions(); len(fixed) > 0 {
+				fmt.Println("\t\t", redFormat("Options "+strings.Join(fixed, ", ")+" can only be set when the collection is created, the scripts won't change them"))
+			}
 		}
 	}
 }
@@ -169,9 +463,10 @@ func openFileOrFatal(filename string) (file *os.File) {
 	return
 }
 
-func (context *context) makeScriptFiles(diffData data) {
+// makeScriptFiles writes the scripts and the files they need, it gives back the names of all the written files
+func (context *context) makeScriptFiles(diffData data) (files []string) {
 	templateData := templateData{
-		DbName: context.dbName,
+		DbName:   context.dbName,
 		Filename: context.prefix,
 	}
 	if context.copyCredentials {
@@ -179,6 +474,20 @@ func (context *context) makeScriptFiles(diffData data) {
 		templateData.Password = context.password
 	}
 
+	manifest := replayManifest{
+		DbName: context.dbName,
+	}
+	databases := make(map[string]int)
+	startingPoints := context.startingPoints
+	if startingPoints == nil {
+		startingPoints = context.startingPointsOf(diffData)
+	}
+	progress := exportProgress{}
+	for _, ids := range diffData {
+		progress.total += len(ids.Ids) + len(ids.Modified)
+	}
+	defer progress.done()
+
 	var toRemove []*os.File
 	defer func() {
 		for _, f := range toRemove {
@@ -186,38 +495,177 @@ func (context *context) makeScriptFiles(diffData data) {
 		}
 	}()
 
-	for collectionName, ids := range diffData {
-		importScriptFilename := fmt.Sprintf("%s_%s.json", context.prefix, collectionName)
-		importScript := openFileOrFatal(importScriptFilename)
-		toRemove = append(toRemove, importScript)
-		writerImportScript := bufio.NewWriter(importScript)
-
-		var newIds []string
-		for id := range ids.Ids {
-			switch t := id.(type) {
-			case bson.ObjectId:
-				newIds = append(newIds, fmt.Sprintf(`ObjectId("%v")`, id.(bson.ObjectId).Hex()))
-			case string:
-				newIds = append(newIds, fmt.Sprintf(`"%v"`, id.(string)))
-			default:
-				log.Fatalf("Can not handle this type: [%T] yet, please report issue on github.com/milanaleksic/mongodiff", t)
+	for _, namespace := range diffData.namespaces() {
+		ids := diffData[namespace]
+		dbName, collectionName := splitNamespace(namespace)
+		change := collectionChange{
+			CollectionName: collectionName,
+		}
+		manifestChange := manifestCollection{
+			Database: dbName,
+			Name:     collectionName,
+			Before:   startingPoints[namespace],
+		}
+		// the documents of created and dropped collections don't have to be removed one by one,
+		// the clean script drops a created collection and the replay script a dropped one
+		created, dropped := false, false
+		if metadataChanges := ids.MetadataChanges; metadataChanges != nil {
+			change.Replay = metadataChanges.replaySteps(collectionName)
+			change.Clean = metadataChanges.cleanSteps(collectionName)
+			manifestChange.Metadata = metadataChanges.manifest(collectionName)
+			created, dropped = metadataChanges.Created, metadataChanges.Dropped
+		}
+		changedIds := listChangedIds(ids, &change, &manifestChange, created, dropped)
+		// there is nothing to import when only the indexes or options have been changed
+		if ids.MetadataChanges == nil || len(changedIds) > 0 {
+			importScriptFilename := fmt.Sprintf("%s_%s.json", context.prefix, context.filenameFor(namespace))
+			importScript := openFileOrFatal(importScriptFilename)
+			files = append(files, importScriptFilename)
+			toRemove = append(toRemove, importScript)
+			writerImportScript := bufio.NewWriter(importScript)
+			change.ImportScriptName = importScriptFilename
+			manifestChange.ImportFile = filepath.Base(importScriptFilename)
+			context.dumpJSONToFile(namespace, changedIds, writerImportScript, &progress)
+			flushOrFatal(writerImportScript)
+		}
+		if len(ids.Documents) > 0 {
+			change.RestoreScriptName = fmt.Sprintf("%s_%s_original.json", context.prefix, context.filenameFor(namespace))
+			manifestChange.RestoreFile = filepath.Base(change.RestoreScriptName)
+			restoreScript := openFileOrFatal(change.RestoreScriptName)
+			files = append(files, change.RestoreScriptName)
+			toRemove = append(toRemove, restoreScript)
+			writerRestoreScript := bufio.NewWriter(restoreScript)
+			for _, document := range ids.Documents {
+				raw := bson.D{}
+				if err := bson.Unmarshal(document, &raw); err != nil {
+					log.Fatalln("Could not Unmarshal original document", err)
+				}
+				writeJSON(raw, writerRestoreScript)
 			}
-			context.dumpJSONToFile(collectionName, id, writerImportScript)
+			flushOrFatal(writerRestoreScript)
 		}
-		templateData.CollectionChanges = append(templateData.CollectionChanges, collectionChange{
-			collectionName, importScriptFilename, newIds,
-		})
+		templateData.add(dbName, change, databases)
+		manifest.Collections = append(manifest.Collections, manifestChange)
 	}
-	templateData.WriteTemplates()
+	files = append(files, templateData.WriteTemplates()...)
+	manifest.write(manifestFilename(context.prefix))
+	return append(files, manifestFilename(context.prefix))
 }
 
-func (context *context) dumpJSONToFile(collectionName string, id interface{}, writerImportScript *bufio.Writer) {
-	raw := bson.D{}
-	err := context.db.C(collectionName).Find(bson.M{"_id": id}).One(&raw)
-	if err != nil {
-		log.Fatalln("Could not open Marshal raw data", err)
+// listChangedIds puts the ids of the collection into the scripts and the manifest, the added and modified
+// ones are given back so that their documents can be exported
+func listChangedIds(ids collectionIds, change *collectionChange, manifestChange *manifestCollection, created bool, dropped bool) (changedIds []interface{}) {
+	for id := range ids.Ids {
+		if !created {
+			change.AddedIds = append(change.AddedIds, shellLiteral(id))
+		}
+		manifestChange.Added = append(manifestChange.Added, extendedJSON(idValue(id)))
+		changedIds = append(changedIds, id)
+	}
+	for id := range ids.Modified {
+		// a modified document whose original hasn't been kept (e.g. when tailing the oplog) can't be restored,
+		// so the clean script leaves it in its new version and the replay script replaces it
+		if _, kept := ids.Documents[id]; kept {
+			change.ModifiedIds = append(change.ModifiedIds, shellLiteral(id))
+		} else {
+			change.ReplacedIds = append(change.ReplacedIds, shellLiteral(id))
+			manifestChange.Unrestorable = append(manifestChange.Unrestorable, extendedJSON(idValue(id)))
+		}
+		manifestChange.Modified = append(manifestChange.Modified, extendedJSON(idValue(id)))
+		changedIds = append(changedIds, id)
 	}
-	output, err := bsonutil.ConvertBSONValueToJSON(raw)
+	for id := range ids.Removed {
+		if !dropped {
+			change.RemovedIds = append(change.RemovedIds, shellLiteral(id))
+		}
+		manifestChange.Removed = append(manifestChange.Removed, extendedJSON(idValue(id)))
+	}
+	return
+}
+
+// filenameFor gives back the part of the file names which identifies the collection, the DB is
+// mentioned only when more than one is being monitored
+func (context *context) filenameFor(namespace string) string {
+	if context.allDbs || len(context.dbNames) > 1 {
+		return namespace
+	}
+	_, collectionName := splitNamespace(namespace)
+	return collectionName
+}
+
+// exportBatchSize is the number of ids fetched by a single query when exporting the documents
+const exportBatchSize = 1000
+
+// exportProgress reports the progress of the export the same way scanning does
+type exportProgress struct {
+	exported int
+	total    int
+}
+
+func (progress *exportProgress) add(count int) {
+	progress.exported += count
+	fmt.Printf("\r%sExporting documents %s", resetFormat, redFormat(fmt.Sprintf("%d/%d", progress.exported, progress.total)))
+}
+
+func (progress *exportProgress) done() {
+	if progress.total > 0 {
+		fmt.Printf("\rExporting completed!%*s\n", len(fmt.Sprint(progress.total))*2+1, "")
+	}
+}
+
+// dumpJSONToFile fetches the documents in batches of ids and streams them to the writer
+func (context *context) dumpJSONToFile(namespace string, ids []interface{}, writerImportScript *bufio.Writer, progress *exportProgress) {
+	context.fetchDocuments(namespace, ids, func(document bson.Raw) {
+		raw := bson.D{}
+		if err := document.Unmarshal(&raw); err != nil {
+			log.Fatalln("Could not Unmarshal changed document", err)
+		}
+		writeJSON(raw, writerImportScript)
+	}, progress.add)
+}
+
+// fetchDocuments reads the documents with the given ids using a query per exportBatchSize ids,
+// afterBatch is told how many documents have been read by each query
+func (context *context) fetchDocuments(namespace string, ids []interface{}, handle func(document bson.Raw), afterBatch func(count int)) {
+	for start := 0; start < len(ids); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var values []interface{}
+		for _, id := range ids[start:end] {
+			values = append(values, idValue(id))
+		}
+		found := 0
+		iter := context.collection(namespace).Find(bson.M{"_id": bson.M{"$in": values}}).Iter()
+		raw := bson.Raw{}
+		for iter.Next(&raw) {
+			handle(raw)
+			found++
+		}
+		if err := iter.Close(); err != nil {
+			log.Fatalln("Could not fetch changed documents", err)
+		}
+		if found != len(values) {
+			log.Fatalf("Only %d of %d changed documents have been found in %s, was the DB changed in the meantime?", found, len(values), namespace)
+		}
+		afterBatch(found)
+	}
+}
+
+func writeJSON(raw bson.D, writer *bufio.Writer) {
+	fmt.Fprintf(writer, "%s\n", extendedJSON(raw))
+}
+
+func flushOrFatal(writer *bufio.Writer) {
+	if err := writer.Flush(); err != nil {
+		log.Fatalln("Could not flush the file contents!", err)
+	}
+}
+
+// extendedJSON gives back the value in the MongoDB Extended JSON format, the way mongoimport expects it
+func extendedJSON(value interface{}) json.RawMessage {
+	output, err := bsonutil.ConvertBSONValueToJSON(value)
 	if err != nil {
 		log.Fatalln("Could not convert to JSON", err)
 	}
@@ -226,9 +674,5 @@ func (context *context) dumpJSONToFile(collectionName string, id interface{}, wr
 	if err != nil {
 		log.Fatalln("Could not Marshal JSON into bytes", err)
 	}
-	fmt.Fprintf(writerImportScript, "%s\n", out)
-	err = writerImportScript.Flush()
-	if err != nil {
-		log.Fatalln("Could not flush the file contents!", err)
-	}
+	return out
 }
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -28,6 +29,146 @@ func TestWhenAddingToNonExistingDatabase(t *testing.T) {
 	}
 }
 
+func TestWhenModifyingExistingDocument(t *testing.T) {
+	preData := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true, "bar": true},
+			Hashes: map[interface{}]string{"foo": "1", "bar": "2"},
+		},
+	}
+	postData := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true, "bar": true},
+			Hashes: map[interface{}]string{"foo": "1", "bar": "3"},
+		},
+	}
+	dummyContext := &context{}
+	diff := dummyContext.diffData(preData, postData)
+	if len(diff) != 1 || len(diff["diffTest"].Ids) != 0 || len(diff["diffTest"].Modified) != 1 || !diff["diffTest"].Modified["bar"] {
+		t.Fatal("Expected deduction of one modification but got", diff)
+	}
+}
+
+func TestWhenRemovingDocument(t *testing.T) {
+	preData := data{
+		"diffTest": collectionIds{
+			Ids:       map[interface{}]bool{"foo": true, "bar": true},
+			Hashes:    map[interface{}]string{"foo": "1", "bar": "2"},
+			Documents: map[interface{}][]byte{"foo": []byte("1"), "bar": []byte("2")},
+		},
+	}
+	postData := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true},
+			Hashes: map[interface{}]string{"foo": "1"},
+		},
+	}
+	dummyContext := &context{}
+	diff := dummyContext.diffData(preData, postData)
+	if len(diff) != 1 || len(diff["diffTest"].Removed) != 1 || !diff["diffTest"].Removed["bar"] {
+		t.Fatal("Expected deduction of one removal but got", diff)
+	}
+	if len(diff["diffTest"].Documents) != 1 || string(diff["diffTest"].Documents["bar"]) != "2" {
+		t.Fatal("Expected original contents of the removed document to be kept, but got", diff["diffTest"].Documents)
+	}
+}
+
+func TestWhenDroppingCollection(t *testing.T) {
+	preData := data{
+		"test.diffTest": collectionIds{
+			Ids:       map[interface{}]bool{"foo": true},
+			Hashes:    map[interface{}]string{"foo": "1"},
+			Documents: map[interface{}][]byte{"foo": []byte("1")},
+			Metadata:  &collectionMetadata{Type: "collection", Options: bson.D{{Name: "capped", Value: true}}},
+		},
+	}
+	diff := (&context{}).diffData(preData, data{})
+	dropped := diff["test.diffTest"]
+	if dropped.MetadataChanges == nil || !dropped.MetadataChanges.Dropped || !dropped.Removed["foo"] || string(dropped.Documents["foo"]) != "1" {
+		t.Fatal("Expected collection to be dropped with its original documents kept, but got", dropped)
+	}
+}
+
+func TestWhenCreatingCollection(t *testing.T) {
+	postData := data{
+		"test.diffTest": collectionIds{
+			Ids:       map[interface{}]bool{"foo": true},
+			Hashes:    map[interface{}]string{"foo": "1"},
+			Documents: map[interface{}][]byte{"foo": []byte("1")},
+			Metadata:  &collectionMetadata{Type: "collection"},
+		},
+	}
+	diff := (&context{}).diffData(data{}, postData)
+	created := diff["test.diffTest"]
+	if created.MetadataChanges == nil || !created.MetadataChanges.Created || !created.Ids["foo"] {
+		t.Fatal("Expected collection to be created with its document, but got", created)
+	}
+	if len(created.Documents) != 0 || len(created.Hashes) != 0 {
+		t.Error("Expected the documents of the new collection not to be kept as originals, but got", created)
+	}
+}
+
+func TestModificationIsIgnoredWhenOnlyIdsWereScanned(t *testing.T) {
+	preData := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true, "bar": true},
+			Hashes: map[interface{}]string{},
+		},
+	}
+	postData := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true, "bar": true},
+			Hashes: map[interface{}]string{"foo": "1", "bar": "3"},
+		},
+	}
+	dummyContext := &context{}
+	if diff := dummyContext.diffData(preData, postData); len(diff) != 0 {
+		t.Fatal("Expected no changes without fingerprints but got", diff)
+	}
+}
+
+func TestScanStats(t *testing.T) {
+	stats := scanStats{namespace: "test.diffTest", documents: 2000, bytes: 4 * 1024 * 1024, duration: 2 * time.Second}
+	expected := "test.diffTest: 2000 documents, 4.0 MB in 2s (1000 documents/s, 2.0 MB/s)"
+	if stats.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, stats.String())
+	}
+}
+
+func TestNamespacesOfSeveralDatabases(t *testing.T) {
+	dbName, collectionName := splitNamespace("accounts.users.archive")
+	if dbName != "accounts" || collectionName != "users.archive" {
+		t.Error("Unexpected split of the namespace", dbName, collectionName)
+	}
+
+	singleDb := &context{dbName: "accounts", excludes: "sessions,billing.cache"}
+	severalDbs := &context{dbName: "accounts", dbNames: []string{"accounts", "billing"}}
+	if singleDb.filenameFor("accounts.users") != "users" || severalDbs.filenameFor("accounts.users") != "accounts.users" {
+		t.Error("DB should be part of the file names only when several DBs are monitored")
+	}
+	if !singleDb.isExcluded("accounts.sessions") || !singleDb.isExcluded("billing.cache") || singleDb.isExcluded("accounts.cache") {
+		t.Error("Excludes should match either the collection name or the whole namespace")
+	}
+
+	recorder := &oplogRecorder{context: severalDbs}
+	if pattern := recorder.namespacePattern(); pattern != `^(accounts|billing)\.` {
+		t.Error("Unexpected oplog namespace pattern", pattern)
+	}
+}
+
+func TestNoChangesDetected(t *testing.T) {
+	snapshot := data{
+		"diffTest": collectionIds{
+			Ids:    map[interface{}]bool{"foo": true},
+			Hashes: map[interface{}]string{"foo": "1"},
+		},
+	}
+	dummyContext := &context{}
+	if diff := dummyContext.diffData(snapshot, snapshot); len(diff) != 0 {
+		t.Fatal("Expected no changes but got", diff)
+	}
+}
+
 func TestDiffDetection(t *testing.T) {
 	preFile := havingTestDataRemovalScript(t)
 	postFile := havingTestDataInjectionScript(t)
@@ -116,6 +257,200 @@ func TestDiffDetectionBug5(t *testing.T) {
 	}, func() { executeClean(t) }, []interface{}{"foo"})
 }
 
+func TestUpdateDetection(t *testing.T) {
+	preFile := havingTestDataForUpdate(t)
+	postFile := havingTestDataUpdateScript(t)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+
+	if len(diffData["test.diffTest"].Ids) != 0 || !diffData["test.diffTest"].Modified["bar"] {
+		t.Error("Expected only modification of document bar, but got:", diffData["test.diffTest"])
+		t.FailNow()
+	}
+
+	context.makeScriptFiles(diffData)
+	context.fieldChanges(diffData).write(fieldChangesFilename("testing"))
+
+	thenDIFFJsonHasExpectedChange(t, `{"_id":"bar","v":2}`)
+	fieldChanges, err := ioutil.ReadFile("./testing_field_changes.json")
+	if err != nil || !strings.Contains(string(fieldChanges), `"path": "v"`) {
+		t.Error("Expected change of field v in the field changes, but got:", string(fieldChanges), err)
+	}
+}
+
+func TestIndexAndValidatorDetection(t *testing.T) {
+	preFile := testFile(t, "test_metadata_pre", `
+			db.diffTest.dropIndexes();
+			db.runCommand({"collMod": "diffTest", "validator": {}});
+		`)
+	postFile := testFile(t, "test_metadata_post", `
+			db.diffTest.createIndex({"v": 1}, {"name": "v_1"});
+			db.runCommand({"collMod": "diffTest", "validator": {"v": {"$exists": true}}, "validationLevel": "moderate"});
+		`)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+
+	changes := diffData["test.diffTest"].MetadataChanges
+	if changes == nil || indexNames(changes.AddedIndexes)[0] != `"v_1"` || len(changes.ChangedOptions) != 2 {
+		t.Fatal("Expected added index and changed validator, but got:", changes)
+	}
+	context.makeScriptFiles(diffData)
+	replayScript, err := ioutil.ReadFile("./testing_replay.js")
+	if err != nil || !strings.Contains(string(replayScript), `"createIndexes": "diffTest"`) || !strings.Contains(string(replayScript), `"collMod": "diffTest"`) {
+		t.Error("Expected index and validator in the replay script, but got:", string(replayScript), err)
+	}
+	run("mongo", "localhost:27017/test", "./testing_clean.js")
+	if cleaned := context.diffData(beforeData, context.collectData(false)); cleaned["test.diffTest"].MetadataChanges != nil {
+		t.Error("Expected the clean script to restore the indexes and options, but got:", cleaned["test.diffTest"].MetadataChanges)
+	}
+}
+
+func TestDroppedCollectionDetection(t *testing.T) {
+	preFile := testFile(t, "test_drop_pre", `
+			db.droppedTest.drop();
+			db.createCollection("droppedTest", {"capped": true, "size": 65536});
+			db.droppedTest.insert({ "_id" : "foo", "v" : "original" });
+		`)
+	postFile := testFile(t, "test_drop_post", `db.droppedTest.drop();`)
+	defer removeTestFilesIncluding(preFile, postFile)
+	defer func() {
+		_ = os.Remove("./testing_droppedTest_original.json")
+	}()
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+
+	dropped := diffData["test.droppedTest"]
+	if dropped.MetadataChanges == nil || !dropped.MetadataChanges.Dropped || !dropped.Removed["foo"] {
+		t.Fatal("Expected drop of collection droppedTest, but got:", dropped)
+	}
+	context.makeScriptFiles(diffData)
+	cleanScript, err := ioutil.ReadFile("./testing_clean.js")
+	if err != nil || !strings.Contains(string(cleanScript), `db.createCollection("droppedTest", {"capped": true, "size": NumberInt(65536)});`) {
+		t.Error("Expected the clean script to create the collection with its options, but got:", string(cleanScript), err)
+	}
+	original, err := ioutil.ReadFile("./testing_droppedTest_original.json")
+	if err != nil || !strings.Contains(string(original), `{"_id":"foo","v":"original"}`) {
+		t.Error("Expected original documents of the dropped collection, but got:", string(original), err)
+	}
+}
+
+func TestExportOfManyDocuments(t *testing.T) {
+	preFile := testFile(t, "test_export_pre", `db.diffTest.remove({});`)
+	postFile := testFile(t, "test_export_post", fmt.Sprintf(`
+			for (var i = 0; i < %d; i++) { db.diffTest.insert({ "_id" : i }); }
+		`, exportBatchSize+1))
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	context.makeScriptFiles(context.diffData(beforeData, context.collectData(false)))
+
+	data, err := ioutil.ReadFile("./testing_diffTest.json")
+	if err != nil {
+		t.Fatal("Could not verify generated JSON file!", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != exportBatchSize+1 {
+		t.Errorf("Expected %d exported documents, but got %d", exportBatchSize+1, lines)
+	}
+}
+
+func TestRemovalDetection(t *testing.T) {
+	preFile := havingTestDataForRemoval(t)
+	postFile := havingTestDataRemovalScriptForBug5(t)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+
+	if !diffData["test.diffTest"].Removed["foo"] {
+		t.Error("Expected removal of document foo, but got:", diffData["test.diffTest"])
+		t.FailNow()
+	}
+
+	context.makeScriptFiles(diffData)
+
+	original, err := ioutil.ReadFile("./testing_diffTest_original.json")
+	if err != nil || !strings.Contains(string(original), `{"_id":"foo","v":"original"}`) {
+		t.Error("Could not verify original contents of the removed document:", string(original), err)
+		t.FailNow()
+	}
+}
+
+func TestDiffDetectionOfAllIdTypes(t *testing.T) {
+	ids := []string{
+		`NumberInt(42)`,
+		`NumberLong("1099511627776")`,
+		`12.5`,
+		`UUID("aaf52b19-6c25-11e5-86ae-af5a85ef200c")`,
+		`BinData(0, "YWJj")`,
+		`ISODate("2015-08-18T07:00:03.450Z")`,
+		`NumberDecimal("12.50")`,
+		`{"b": 1, "a": {"c": "x"}}`,
+	}
+	var removal, injection string
+	for _, id := range ids {
+		removal += fmt.Sprintf("db.diffTest.remove({\"_id\": %s});\n", id)
+		injection += fmt.Sprintf("db.diffTest.insert({\"_id\": %s, \"v\": 1});\n", id)
+	}
+	preFile := testFile(t, "test_post8", removal)
+	postFile := testFile(t, "test_post9", injection)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+
+	if len(diffData["test.diffTest"].Ids) != len(ids) {
+		t.Error("Expected every id type to be detected, but got:", diffData["test.diffTest"].Ids)
+		t.FailNow()
+	}
+
+	context.makeScriptFiles(diffData)
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData = context.collectData(true)
+	executeClean(t)
+	diffData = context.diffData(beforeData, context.collectData(false))
+
+	if len(diffData["test.diffTest"].Ids) != len(ids) {
+		t.Error("Expected every id type to be replayed, but got:", diffData["test.diffTest"].Ids)
+		t.FailNow()
+	}
+}
+
 func executeClean(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		run("testing_clean.bat")
@@ -184,6 +519,24 @@ func havingTestDataInjectionScriptForBug5(t *testing.T) (postFile *os.File) {
 	return testFile(t, "test_post4", `db.diffTest.insert({"_id": "foo"});`)
 }
 
+func havingTestDataForUpdate(t *testing.T) (preFile *os.File) {
+	return testFile(t, "test_post5", `
+			db.diffTest.remove({ "_id" : "bar" });
+			db.diffTest.insert({ "_id" : "bar", "v" : 1 });
+		`)
+}
+
+func havingTestDataForRemoval(t *testing.T) (preFile *os.File) {
+	return testFile(t, "test_post7", `
+			db.diffTest.remove({ "_id" : "foo" });
+			db.diffTest.insert({ "_id" : "foo", "v" : "original" });
+		`)
+}
+
+func havingTestDataUpdateScript(t *testing.T) (postFile *os.File) {
+	return testFile(t, "test_post6", `db.diffTest.update({"_id": "bar"}, {"$set": {"v": 2}});`)
+}
+
 func testFile(t *testing.T, prefix string, content string) (postFile *os.File) {
 	postFile, err := ioutil.TempFile("", prefix)
 	if err != nil {
@@ -198,21 +551,21 @@ func testFile(t *testing.T, prefix string, content string) (postFile *os.File) {
 
 func thenCalculationOfDeltaContains(t *testing.T, context *context, preHook func(), changeHook func(), changeIds []interface{}) (diffData data) {
 	preHook()
-	beforeData := context.collectData()
+	beforeData := context.collectData(true)
 	// fmt.Printf("After pre hook: %v\n", beforeData)
 	changeHook()
-	afterData := context.collectData()
+	afterData := context.collectData(false)
 	// fmt.Printf("After change hook: %v\n", beforeData)
 	diffData = context.diffData(beforeData, afterData)
 	// fmt.Printf("Diff: %v\n", diffData)
 
-	if len(diffData["diffTest"].Ids) != len(changeIds) {
-		t.Error("Expected this many elements in diff for diffTest:", len(changeIds), "but was:", len(diffData["diffTest"].Ids))
+	if len(diffData["test.diffTest"].Ids) != len(changeIds) {
+		t.Error("Expected this many elements in diff for diffTest:", len(changeIds), "but was:", len(diffData["test.diffTest"].Ids))
 		t.FailNow()
 	}
 	for _, id := range changeIds {
-		if !diffData["diffTest"].Ids[id] {
-			t.Error("Could not find expected ID in the diff!", len(diffData["diffTest"].Ids))
+		if !diffData["test.diffTest"].Ids[id] {
+			t.Error("Could not find expected ID in the diff!", len(diffData["test.diffTest"].Ids))
 			t.FailNow()
 		}
 	}
@@ -246,8 +599,14 @@ func havingContextInstance(t *testing.T) (mongodiffContext *context) {
 }
 
 func removeTestFilesIncluding(extra ...*os.File) {
+	_ = os.Remove("./testing.json")
 	_ = os.Remove("./testing_clean.js")
+	_ = os.Remove("./testing_replay.js")
 	_ = os.Remove("./testing_diffTest.json")
+	_ = os.Remove("./testing_diffTest_original.json")
+	_ = os.Remove("./testing_field_changes.json")
+	_ = os.Remove("./testing_report.json")
+	_ = os.Remove("./testing_report.html")
 	_ = os.Remove("./testing.sh")
 	_ = os.Remove("./testing.bat")
 	_ = os.Remove("./testing_clean.sh")
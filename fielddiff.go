@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fieldChange is a single difference between the original and the new version of a document,
+// elements of arrays are addressed by their index (e.g. items.2.price)
+type fieldChange struct {
+	Path   string          `json:"path"`
+	Change string          `json:"change"`
+	Old    json.RawMessage `json:"old,omitempty"`
+	New    json.RawMessage `json:"new,omitempty"`
+}
+
+const (
+	fieldAdded   = "added"
+	fieldRemoved = "removed"
+	fieldChanged = "changed"
+)
+
+// fieldChanges holds the changes of the modified documents by their namespace and id
+type fieldChanges map[string]map[interface{}][]fieldChange
+
+// documentFieldChanges is the form in which the changes of a document are written to the file
+type documentFieldChanges struct {
+	Namespace string          `json:"namespace"`
+	ID        json.RawMessage `json:"_id"`
+	Changes   []fieldChange   `json:"changes"`
+}
+
+// fieldChanges compares the modified documents with their originals, the documents whose
+// originals haven't been kept (e.g. when recording the oplog) are left out
+func (context *context) fieldChanges(diffData data) fieldChanges {
+	changes := make(fieldChanges)
+	for _, namespace := range diffData.namespaces() {
+		ids := diffData[namespace]
+		var modified []interface{}
+		for id := range ids.Modified {
+			if _, ok := ids.Documents[id]; ok {
+				modified = append(modified, id)
+			}
+		}
+		if len(modified) == 0 {
+			continue
+		}
+		changes[namespace] = make(map[interface{}][]fieldChange)
+		context.fetchDocuments(namespace, modified, func(document bson.Raw) {
+			item := collectionItem{}
+			if err := document.Unmarshal(&item); err != nil {
+				log.Fatalln("Could not read document id", err)
+			}
+			id := item.key()
+			changes[namespace][id] = compareDocuments("", ids.Documents[id], document.Data)
+		}, func(int) {})
+	}
+	return changes
+}
+
+// compareDocuments walks through both documents and gives back the paths which differ
+func compareDocuments(path string, before []byte, after []byte) (changes []fieldChange) {
+	beforeElements, afterElements := rawElements(before), rawElements(after)
+	afterValues := make(map[string]bson.Raw, len(afterElements))
+	for _, element := range afterElements {
+		afterValues[element.Name] = element.Value
+	}
+	beforeNames := make(map[string]bool, len(beforeElements))
+	for _, element := range beforeElements {
+		beforeNames[element.Name] = true
+		fieldPath := joinPath(path, element.Name)
+		afterValue, ok := afterValues[element.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fieldChange{Path: fieldPath, Change: fieldRemoved, Old: rawJSON(element.Value)})
+		case element.Value.Kind == afterValue.Kind && (afterValue.Kind == 0x03 || afterValue.Kind == 0x04):
+			changes = append(changes, compareDocuments(fieldPath, element.Value.Data, afterValue.Data)...)
+		case element.Value.Kind != afterValue.Kind || !bytes.Equal(element.Value.Data, afterValue.Data):
+			changes = append(changes, fieldChange{Path: fieldPath, Change: fieldChanged, Old: rawJSON(element.Value), New: rawJSON(afterValue)})
+		}
+	}
+	for _, element := range afterElements {
+		if !beforeNames[element.Name] {
+			changes = append(changes, fieldChange{Path: joinPath(path, element.Name), Change: fieldAdded, New: rawJSON(element.Value)})
+		}
+	}
+	return
+}
+
+func rawElements(document []byte) (elements bson.RawD) {
+	if err := bson.Unmarshal(document, &elements); err != nil {
+		log.Fatalln("Could not Unmarshal document", err)
+	}
+	return
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// rawJSON renders a single BSON value in the MongoDB Extended JSON format
+func rawJSON(value bson.Raw) json.RawMessage {
+	if value.Kind == 0x03 {
+		document := bson.D{}
+		if err := value.Unmarshal(&document); err != nil {
+			log.Fatalln("Could not Unmarshal document", err)
+		}
+		return extendedJSON(document)
+	}
+	var converted interface{}
+	if err := value.Unmarshal(&converted); err != nil {
+		log.Fatalln("Could not Unmarshal value", err)
+	}
+	return extendedJSON(converted)
+}
+
+func (change fieldChange) String() string {
+	switch change.Change {
+	case fieldAdded:
+		return fmt.Sprintf("+ %s: %s", change.Path, change.New)
+	case fieldRemoved:
+		return fmt.Sprintf("- %s: %s", change.Path, change.Old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", change.Path, change.Old, change.New)
+}
+
+func fieldChangesFilename(prefix string) string {
+	return prefix + "_field_changes.json"
+}
+
+// write saves the changes of all the documents to a JSON file, sorted by namespace and id;
+// nothing is written when there are no changes
+func (changes fieldChanges) write(filename string) (written bool) {
+	var documents []documentFieldChanges
+	for namespace, ids := range changes {
+		for id, fields := range ids {
+			documents = append(documents, documentFieldChanges{Namespace: namespace, ID: extendedJSON(idValue(id)), Changes: fields})
+		}
+	}
+	if len(documents) == 0 {
+		return false
+	}
+	sort.Slice(documents, func(i, j int) bool {
+		if documents[i].Namespace != documents[j].Namespace {
+			return documents[i].Namespace < documents[j].Namespace
+		}
+		return string(documents[i].ID) < string(documents[j].ID)
+	})
+	out, err := json.MarshalIndent(documents, "", "  ")
+	if err != nil {
+		log.Fatalln("Could not Marshal field changes", err)
+	}
+	if err := ioutil.WriteFile(filename, out, 0600); err != nil {
+		log.Fatalf("Could not save field changes %s: %v", filename, err)
+	}
+	return true
+}
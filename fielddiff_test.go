@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFieldChangesOfModifiedDocument(t *testing.T) {
+	before, _ := bson.Marshal(bson.D{
+		{Name: "_id", Value: "foo"},
+		{Name: "name", Value: "Ann"},
+		{Name: "age", Value: 30},
+		{Name: "address", Value: bson.D{{Name: "city", Value: "Belgrade"}, {Name: "zip", Value: "11000"}}},
+		{Name: "tags", Value: []interface{}{"a", "b", "c"}},
+		{Name: "legacy", Value: true},
+	})
+	after, _ := bson.Marshal(bson.D{
+		{Name: "_id", Value: "foo"},
+		{Name: "name", Value: "Ann"},
+		{Name: "age", Value: int64(30)},
+		{Name: "address", Value: bson.D{{Name: "city", Value: "Novi Sad"}, {Name: "zip", Value: "11000"}}},
+		{Name: "tags", Value: []interface{}{"a", "x"}},
+		{Name: "email", Value: "ann@example.com"},
+	})
+
+	var changes []string
+	for _, change := range compareDocuments("", before, after) {
+		changes = append(changes, change.String())
+	}
+	expected := []string{
+		`~ age: 30 -> {"$numberLong":"30"}`,
+		`~ address.city: "Belgrade" -> "Novi Sad"`,
+		`~ tags.1: "b" -> "x"`,
+		`- tags.2: "c"`,
+		`- legacy: true`,
+		`+ email: "ann@example.com"`,
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes:\n%v\nbut got:\n%v", expected, changes)
+	}
+}
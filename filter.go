@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// namePattern matches a collection either by a glob (e.g. *_cache) or by a regular expression,
+// which is recognized by a leading ^ or by being enclosed in slashes (e.g. ^tmp\. or /session/)
+type namePattern struct {
+	source string
+	regexp *regexp.Regexp
+}
+
+func parsePatterns(list string) (patterns []namePattern, err error) {
+	for _, source := range strings.Split(list, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		pattern := namePattern{source: source}
+		expression := ""
+		if strings.HasPrefix(source, "^") {
+			expression = source
+		} else if len(source) > 1 && strings.HasPrefix(source, "/") && strings.HasSuffix(source, "/") {
+			expression = source[1 : len(source)-1]
+		} else if _, err = path.Match(source, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", source, err)
+		}
+		if expression != "" {
+			if pattern.regexp, err = regexp.Compile(expression); err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", source, err)
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return
+}
+
+// matches checks the pattern against both the collection name and the whole namespace,
+// so that patterns can be qualified with the DB (e.g. billing.*)
+func (pattern namePattern) matches(namespace string) bool {
+	_, collection := splitNamespace(namespace)
+	for _, name := range []string{collection, namespace} {
+		if pattern.regexp != nil {
+			if pattern.regexp.MatchString(name) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern.source, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionFilter decides which collections are recorded: when there are includes a collection
+// must match one of them, and it must not match any of the excludes
+type collectionFilter struct {
+	includes []namePattern
+	excludes []namePattern
+}
+
+func newCollectionFilter(includes string, excludes string) (filter collectionFilter, err error) {
+	if filter.includes, err = parsePatterns(includes); err != nil {
+		return
+	}
+	filter.excludes, err = parsePatterns(excludes)
+	return
+}
+
+// skipReason explains why the collection shouldn't be recorded, it is empty for the recorded ones
+func (filter collectionFilter) skipReason(namespace string) string {
+	for _, pattern := range filter.excludes {
+		if pattern.matches(namespace) {
+			return "excluded by " + pattern.source
+		}
+	}
+	if len(filter.includes) == 0 {
+		return ""
+	}
+	for _, pattern := range filter.includes {
+		if pattern.matches(namespace) {
+			return ""
+		}
+	}
+	return "not matching any of the includes"
+}
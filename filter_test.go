@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestFilterPatterns(t *testing.T) {
+	filter, err := newCollectionFilter("", `*_cache,^tmp\.,billing.audit,/^logs[0-9]+$/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectations := map[string]bool{
+		"test.users":          false,
+		"test.users_cache":    true,
+		"test.tmp.imports":    true,
+		"test.tmpusers":       false,
+		"billing.audit":       true,
+		"accounts.audit":      false,
+		"test.logs2019":       true,
+		"test.logs2019.old":   false,
+		"billing.users_cache": true,
+	}
+	for namespace, skipped := range expectations {
+		if reason := filter.skipReason(namespace); (reason != "") != skipped {
+			t.Errorf("Namespace %s should be skipped: %v, but the reason was %q", namespace, skipped, reason)
+		}
+	}
+}
+
+func TestFilterIncludes(t *testing.T) {
+	filter, err := newCollectionFilter("users*,billing.*", "users_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := filter.skipReason("test.users"); reason != "" {
+		t.Errorf("Included collection has been skipped: %s", reason)
+	}
+	if reason := filter.skipReason("billing.invoices"); reason != "" {
+		t.Errorf("Included collection has been skipped: %s", reason)
+	}
+	if reason := filter.skipReason("test.invoices"); reason != "not matching any of the includes" {
+		t.Errorf("Collection not included hasn't been skipped: %q", reason)
+	}
+	if reason := filter.skipReason("test.users_cache"); reason != "excluded by users_cache" {
+		t.Errorf("Exclude should have priority over include: %q", reason)
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	if _, err := newCollectionFilter("[users", ""); err == nil {
+		t.Error("Invalid glob has been accepted")
+	}
+	if _, err := newCollectionFilter("", "^tmp("); err == nil {
+		t.Error("Invalid regex has been accepted")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"html"
+	"html/template"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// htmlReportDocumentLimit is the number of documents per collection shown in the HTML report
+const htmlReportDocumentLimit = 1000
+
+// htmlReport is what the HTML report template gets: the summary plus the documents of every collection
+type htmlReport struct {
+	Report      diffReport
+	Collections []htmlCollection
+}
+
+type htmlCollection struct {
+	Namespace string
+	Counts    changeCounts
+	Documents []htmlDocument
+	Hidden    int
+}
+
+// htmlDocument shows a changed document: its new version (unless removed) and its original version (when kept)
+type htmlDocument struct {
+	Change   string
+	ID       string
+	Fields   []fieldChange
+	Document template.HTML
+	Original template.HTML
+}
+
+// writeHTMLReport writes a single HTML file which needs nothing else to be shown, documents
+// are rendered as collapsible trees with the changed fields highlighted
+func (context *context) writeHTMLReport(report diffReport, diffData data, fields fieldChanges, filename string) {
+	model := htmlReport{Report: report}
+	for _, namespace := range diffData.namespaces() {
+		ids := diffData[namespace]
+		collection := htmlCollection{
+			Namespace: namespace,
+			Counts:    changeCounts{Added: len(ids.Ids), Modified: len(ids.Modified), Removed: len(ids.Removed)},
+		}
+		documents := make(map[interface{}]*htmlDocument)
+		var shown []interface{}
+		add := func(change string, changed map[interface{}]bool) {
+			for _, id := range sortedIds(changed) {
+				if len(documents) == htmlReportDocumentLimit {
+					collection.Hidden++
+					continue
+				}
+				document := &htmlDocument{Change: change, ID: string(extendedJSON(idValue(id))), Fields: fields[namespace][id]}
+				if original, ok := ids.Documents[id]; ok {
+					originalPaths, _ := highlightedPaths(document.Fields)
+					document.Original = template.HTML(jsonTree("", original, originalPaths))
+				}
+				documents[id] = document
+				shown = append(shown, id)
+			}
+		}
+		add("added", ids.Ids)
+		add("modified", ids.Modified)
+		add("removed", ids.Removed)
+
+		var toFetch []interface{}
+		for _, id := range shown {
+			if documents[id].Change != "removed" {
+				toFetch = append(toFetch, id)
+			}
+		}
+		context.fetchDocuments(namespace, toFetch, func(raw bson.Raw) {
+			item := collectionItem{}
+			if err := raw.Unmarshal(&item); err != nil {
+				log.Fatalln("Could not read document id", err)
+			}
+			document := documents[item.key()]
+			_, currentPaths := highlightedPaths(document.Fields)
+			document.Document = template.HTML(jsonTree("", raw.Data, currentPaths))
+		}, func(int) {})
+		for _, id := range shown {
+			collection.Documents = append(collection.Documents, *documents[id])
+		}
+		model.Collections = append(model.Collections, collection)
+	}
+
+	page, err := template.New("report").Parse(string(MustAsset("data/template_report_html")))
+	if err != nil {
+		log.Fatalln("HTML report template couldn't be parsed", err)
+	}
+	file := openFileOrFatal(filename)
+	defer func() {
+		_ = file.Close()
+	}()
+	writer := bufio.NewWriter(file)
+	if err := page.Execute(writer, model); err != nil {
+		log.Fatalln("HTML report template couldn't be expanded", err)
+	}
+	flushOrFatal(writer)
+}
+
+func sortedIds(ids map[interface{}]bool) []interface{} {
+	var sorted []interface{}
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return string(extendedJSON(idValue(sorted[i]))) < string(extendedJSON(idValue(sorted[j])))
+	})
+	return sorted
+}
+
+// highlightedPaths tells which paths should be highlighted in the original and in the new version of the document
+func highlightedPaths(fields []fieldChange) (original map[string]string, current map[string]string) {
+	original, current = make(map[string]string), make(map[string]string)
+	for _, field := range fields {
+		switch field.Change {
+		case fieldRemoved:
+			original[field.Path] = fieldRemoved
+		case fieldAdded:
+			current[field.Path] = fieldAdded
+		default:
+			original[field.Path] = fieldChanged
+			current[field.Path] = fieldChanged
+		}
+	}
+	return
+}
+
+// jsonTree renders the document as nested lists, embedded documents and arrays can be collapsed.
+// The values are rendered in the same Extended JSON form as in the generated files
+func jsonTree(path string, document []byte, highlights map[string]string) string {
+	var tree strings.Builder
+	tree.WriteString(`<ul class="tree">`)
+	for _, element := range rawElements(document) {
+		fieldPath := joinPath(path, element.Name)
+		tree.WriteString(`<li class="` + highlights[fieldPath] + `">`)
+		name := `<span class="key">` + html.EscapeString(element.Name) + `</span>: `
+		if element.Value.Kind == 0x03 || element.Value.Kind == 0x04 {
+			brackets := "{…}"
+			if element.Value.Kind == 0x04 {
+				brackets = "[…]"
+			}
+			tree.WriteString(`<details open><summary>` + name + brackets + `</summary>`)
+			tree.WriteString(jsonTree(fieldPath, element.Value.Data, highlights))
+			tree.WriteString(`</details>`)
+		} else {
+			tree.WriteString(name + `<span class="value">` + html.EscapeString(string(rawJSON(element.Value))) + `</span>`)
+		}
+		tree.WriteString(`</li>`)
+	}
+	tree.WriteString(`</ul>`)
+	return tree.String()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestHTMLTreeHighlightsChangedFields(t *testing.T) {
+	before, _ := bson.Marshal(bson.D{{Name: "name", Value: "it's old"}, {Name: "tags", Value: []string{"a"}}, {Name: "gone", Value: 1}})
+	after, _ := bson.Marshal(bson.D{{Name: "name", Value: "it's new"}, {Name: "tags", Value: []string{"a", "b"}}})
+	original, current := highlightedPaths(compareDocuments("", before, after))
+
+	tree := jsonTree("", after, current)
+	for _, expected := range []string{
+		`<li class="changed"><span class="key">name</span>: <span class="value">&#34;it&#39;s new&#34;</span></li>`,
+		`<summary><span class="key">tags</span>: […]</summary>`,
+		`<li class="added"><span class="key">1</span>: <span class="value">&#34;b&#34;</span></li>`,
+	} {
+		if !strings.Contains(tree, expected) {
+			t.Errorf("Expected %s in the tree %s", expected, tree)
+		}
+	}
+	if tree := jsonTree("", before, original); !strings.Contains(tree, `<li class="removed"><span class="key">gone</span>`) {
+		t.Errorf("Expected removed field to be highlighted in the tree %s", tree)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// documentKey stands in for ids which can't be used as map keys (embedded documents, binaries
+// and JavaScript code with scope), it holds the BSON kind followed by the raw BSON value of the id
+type documentKey string
+
+// idKey gives back the value under which the id is kept in the maps: the id itself when possible
+func idKey(id bson.Raw) interface{} {
+	switch id.Kind {
+	case 0x03, 0x05, 0x0F:
+		return documentKey(append([]byte{id.Kind}, id.Data...))
+	}
+	var value interface{}
+	if err := id.Unmarshal(&value); err != nil {
+		log.Fatalln("Could not read document id", err)
+	}
+	return value
+}
+
+// idValue is the opposite of idKey, it gives back the id as it should be used in queries
+func idValue(key interface{}) interface{} {
+	documentKey, ok := key.(documentKey)
+	if !ok {
+		return key
+	}
+	raw := bson.Raw{Kind: documentKey[0], Data: []byte(documentKey[1:])}
+	if raw.Kind == 0x03 {
+		document := bson.D{}
+		if err := raw.Unmarshal(&document); err != nil {
+			log.Fatalln("Could not read document id", err)
+		}
+		return document
+	}
+	if raw.Kind == 0x05 {
+		return binaryValue(raw.Data)
+	}
+	if raw.Kind == 0x0F {
+		return javaScriptValue(raw.Data)
+	}
+	var value interface{}
+	if err := raw.Unmarshal(&value); err != nil {
+		log.Fatalln("Could not read document id", err)
+	}
+	return value
+}
+
+// binaryValue reads a raw BSON binary keeping its subtype, which is lost when the generic
+// and the old binary subtypes (0 and 2) are unmarshalled into []byte
+func binaryValue(data []byte) bson.Binary {
+	if len(data) < 5 {
+		log.Fatalln("Could not read binary document id")
+	}
+	binary := bson.Binary{Kind: data[4], Data: data[5:]}
+	if binary.Kind == 0x02 && len(binary.Data) >= 4 {
+		// the old binary subtype repeats the length in front of the data
+		binary.Data = binary.Data[4:]
+	}
+	return binary
+}
+
+// javaScriptValue reads raw BSON code with scope keeping the order of the scope, which is
+// lost when the scope is unmarshalled into a map
+func javaScriptValue(data []byte) bson.JavaScript {
+	if len(data) < 8 {
+		log.Fatalln("Could not read JavaScript document id")
+	}
+	// the code with scope consists of its total length, the length of the code, the code with its closing zero and the scope
+	codeLength := int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	if codeLength < 1 || 8+codeLength > len(data) {
+		log.Fatalln("Could not read JavaScript document id")
+	}
+	scope := bson.D{}
+	if err := bson.Unmarshal(data[8+codeLength:], &scope); err != nil {
+		log.Fatalln("Could not read JavaScript document id", err)
+	}
+	return bson.JavaScript{Code: string(data[8 : 8+codeLength-1]), Scope: scope}
+}
+
+// shellLiteral renders the id as a literal that can be used in a Mongo shell script
+func shellLiteral(id interface{}) string {
+	switch id {
+	case bson.MinKey:
+		return "MinKey"
+	case bson.MaxKey:
+		return "MaxKey"
+	}
+	switch t := id.(type) {
+	case nil:
+		return "null"
+	case documentKey:
+		return shellLiteral(idValue(t))
+	case bson.ObjectId:
+		return fmt.Sprintf(`ObjectId("%v")`, t.Hex())
+	case string:
+		return strconv.Quote(t)
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return fmt.Sprintf("NumberInt(%d)", t)
+	case int64:
+		return fmt.Sprintf(`NumberLong("%d")`, t)
+	case float64:
+		switch {
+		case math.IsNaN(t):
+			return "NaN"
+		case math.IsInf(t, 1):
+			return "Infinity"
+		case math.IsInf(t, -1):
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case bson.Decimal128:
+		return fmt.Sprintf(`NumberDecimal("%s")`, t.String())
+	case time.Time:
+		return fmt.Sprintf(`ISODate("%s")`, t.UTC().Format("2006-01-02T15:04:05.000Z"))
+	case bson.MongoTimestamp:
+		return fmt.Sprintf("Timestamp(%d, %d)", uint64(t)>>32, uint32(t))
+	case bson.Binary:
+		if t.Kind == 0x04 && len(t.Data) == 16 {
+			return fmt.Sprintf(`UUID("%s")`, hex.EncodeToString(t.Data))
+		}
+		return fmt.Sprintf(`BinData(%d, "%s")`, t.Kind, base64.StdEncoding.EncodeToString(t.Data))
+	case []byte:
+		// binaries of the generic subtype nested in an id are unmarshalled without their subtype
+		return fmt.Sprintf(`BinData(0, "%s")`, base64.StdEncoding.EncodeToString(t))
+	case bson.RegEx:
+		return fmt.Sprintf("RegExp(%s, %s)", strconv.Quote(t.Pattern), strconv.Quote(t.Options))
+	case bson.JavaScript:
+		if t.Scope == nil {
+			return fmt.Sprintf("Code(%s)", strconv.Quote(t.Code))
+		}
+		return fmt.Sprintf("Code(%s, %s)", strconv.Quote(t.Code), shellLiteral(t.Scope))
+	case bson.Symbol:
+		// the shell has no literal for the deprecated symbols, they are given by their string form
+		return strconv.Quote(string(t))
+	case bson.DBPointer:
+		return fmt.Sprintf("DBPointer(%s, %s)", strconv.Quote(t.Namespace), shellLiteral(t.Id))
+	case bson.D:
+		var elements []string
+		for _, element := range t {
+			elements = append(elements, fmt.Sprintf("%s: %s", strconv.Quote(element.Name), shellLiteral(element.Value)))
+		}
+		return "{" + strings.Join(elements, ", ") + "}"
+	case []interface{}:
+		var elements []string
+		for _, element := range t {
+			elements = append(elements, shellLiteral(element))
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	default:
+		log.Fatalf("Can not handle this type: [%T] yet, please report issue on github.com/milanaleksic/mongodiff", t)
+	}
+	return ""
+}
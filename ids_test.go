@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestShellLiteralsOfAllIdTypes(t *testing.T) {
+	decimal, _ := bson.ParseDecimal128("12.50")
+	expectations := []struct {
+		id       interface{}
+		expected string
+	}{
+		{nil, `null`},
+		{bson.ObjectIdHex("501ca04b668d67b3d6489f3a"), `ObjectId("501ca04b668d67b3d6489f3a")`},
+		{`fo"o`, `"fo\"o"`},
+		{true, `true`},
+		{5, `NumberInt(5)`},
+		{int64(1) << 40, `NumberLong("1099511627776")`},
+		{12.5, `12.5`},
+		{math.Inf(-1), `-Infinity`},
+		{decimal, `NumberDecimal("12.50")`},
+		{time.Date(2015, 8, 18, 7, 0, 3, 450000000, time.UTC), `ISODate("2015-08-18T07:00:03.450Z")`},
+		{bson.MongoTimestamp(5<<32 | 3), `Timestamp(5, 3)`},
+		{bson.Binary{Kind: 0x04, Data: []byte{0xaa, 0xf5, 0x2b, 0x19, 0x6c, 0x25, 0x11, 0xe5, 0x86, 0xae, 0xaf, 0x5a, 0x85, 0xef, 0x20, 0x0c}}, `UUID("aaf52b196c2511e586aeaf5a85ef200c")`},
+		{bson.Binary{Kind: 0x00, Data: []byte("abc")}, `BinData(0, "YWJj")`},
+		{bson.JavaScript{Code: "function() {}"}, `Code("function() {}")`},
+		{bson.JavaScript{Code: "x + 1", Scope: bson.D{{Name: "x", Value: 1}}}, `Code("x + 1", {"x": NumberInt(1)})`},
+		{bson.Symbol("foo"), `"foo"`},
+		{bson.DBPointer{Namespace: "test.users", Id: bson.ObjectIdHex("501ca04b668d67b3d6489f3a")}, `DBPointer("test.users", ObjectId("501ca04b668d67b3d6489f3a"))`},
+		{bson.MinKey, `MinKey`},
+		{bson.MaxKey, `MaxKey`},
+		{bson.D{{Name: "b", Value: 1}, {Name: "a", Value: bson.D{{Name: "c", Value: []interface{}{"x", int64(2)}}}}}, `{"b": NumberInt(1), "a": {"c": ["x", NumberLong("2")]}}`},
+	}
+	for _, expectation := range expectations {
+		if literal := shellLiteral(expectation.id); literal != expectation.expected {
+			t.Errorf("Expected %s for %v (%T), but got %s", expectation.expected, expectation.id, expectation.id, literal)
+		}
+	}
+}
+
+func TestUnhashableIdsAreUsableAsKeys(t *testing.T) {
+	ids := []interface{}{
+		bson.D{{Name: "b", Value: 1}, {Name: "a", Value: bson.D{{Name: "c", Value: "x"}}}},
+		bson.Binary{Kind: 0x04, Data: []byte("0123456789abcdef")},
+		bson.JavaScript{Code: "x + y", Scope: bson.D{{Name: "y", Value: 1}, {Name: "x", Value: 2}}},
+	}
+	keys := make(map[interface{}]bool)
+	for _, id := range ids {
+		document, err := bson.Marshal(bson.D{{Name: "_id", Value: id}})
+		if err != nil {
+			t.Fatal("Could not Marshal test document", err)
+		}
+		collItem := collectionItem{}
+		if err := bson.Unmarshal(document, &collItem); err != nil {
+			t.Fatal("Could not Unmarshal test document", err)
+		}
+		key := collItem.key()
+		keys[key] = true
+		if value := idValue(key); !reflect.DeepEqual(value, id) {
+			t.Errorf("Expected %v (%T) but got %v (%T)", id, id, value, value)
+		}
+	}
+	if len(keys) != len(ids) {
+		t.Error("Expected every id to have its own key, but got", keys)
+	}
+}
+
+func TestBinaryIdsKeepTheirSubtype(t *testing.T) {
+	expectations := []struct {
+		id       interface{}
+		expected string
+	}{
+		{bson.Binary{Kind: 0x00, Data: []byte("abc")}, `BinData(0, "YWJj")`},
+		{bson.Binary{Kind: 0x02, Data: []byte("abc")}, `BinData(2, "YWJj")`},
+		{bson.D{{Name: "key", Value: bson.Binary{Kind: 0x00, Data: []byte("abc")}}}, `{"key": BinData(0, "YWJj")}`},
+	}
+	for _, expectation := range expectations {
+		document, err := bson.Marshal(bson.D{{Name: "_id", Value: expectation.id}})
+		if err != nil {
+			t.Fatal("Could not Marshal test document", err)
+		}
+		collItem := collectionItem{}
+		if err := bson.Unmarshal(document, &collItem); err != nil {
+			t.Fatal("Could not Unmarshal test document", err)
+		}
+		key := collItem.key()
+		if literal := shellLiteral(key); literal != expectation.expected {
+			t.Errorf("Expected %s for %v, but got %s", expectation.expected, expectation.id, literal)
+		}
+		again, err := bson.Marshal(bson.D{{Name: "_id", Value: idValue(key)}})
+		if err != nil {
+			t.Fatal("Could not Marshal id value", err)
+		}
+		if !reflect.DeepEqual(again, document) {
+			t.Errorf("Expected %v to be queried as it is stored, but got %v", expectation.id, idValue(key))
+		}
+	}
+}
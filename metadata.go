@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// collectionMetadata describes the collection itself instead of its documents: whether it is
+// a collection or a view, the options it has (capped, validator, collation, the pipeline of a view...)
+// and its indexes
+type collectionMetadata struct {
+	Type    string   `bson:"type"`
+	Options bson.D   `bson:"options"`
+	Indexes []bson.D `bson:"indexes"`
+}
+
+// collectionInfo is what listCollections tells about a collection
+type collectionInfo struct {
+	Name    string `bson:"name"`
+	Type    string `bson:"type"`
+	Options bson.D `bson:"options"`
+}
+
+// modifiableOptions can be changed by collMod, the other options are fixed when the collection is created
+var modifiableOptions = []string{"validator", "validationLevel", "validationAction", "viewOn", "pipeline"}
+
+// optionDefaults are the values given to collMod when an option has been removed during the recording
+var optionDefaults = map[string]interface{}{"validator": bson.D{}, "validationLevel": "strict", "validationAction": "error"}
+
+// metadataChanges tells how the indexes and options of a collection have been changed during the recording,
+// an index whose definition has changed is both removed and added. A collection which has been created
+// or dropped has only the metadata of one side (if known at all) and all of its indexes but _id
+type metadataChanges struct {
+	Before         *collectionMetadata
+	After          *collectionMetadata
+	Created        bool
+	Dropped        bool
+	AddedIndexes   []bson.D
+	RemovedIndexes []bson.D
+	ChangedOptions []string
+}
+
+// metadataSteps are what a script has to do to bring the indexes and options of a collection into a state:
+// whether to drop the whole collection, the options to create it with, the names of the indexes to drop,
+// the definitions of the indexes to create and the collMod command
+type metadataSteps struct {
+	Drop          bool
+	Create        string
+	DropIndexes   []string
+	CreateIndexes []string
+	CollMod       string
+}
+
+// defaultIndex is created together with every collection
+const defaultIndex = "_id_"
+
+// nameSpaceNotFound and namespaceExists are the error codes of dropping a missing collection
+// and of creating an existing one, neither of them matters when a script is run again
+const (
+	namespaceNotFound = 26
+	namespaceExists   = 48
+)
+
+func (info collectionInfo) isView() bool {
+	return info.Type == "view"
+}
+
+// listCollections gives back the collections of the DB together with their options
+func listCollections(session *mgo.Session, dbName string) (collections []collectionInfo) {
+	runCursorCommand(session.DB(dbName), bson.D{{Name: "listCollections", Value: 1}}, func(raw bson.Raw) {
+		info := collectionInfo{}
+		if err := raw.Unmarshal(&info); err != nil {
+			log.Fatalln("Could not read collection info", err)
+		}
+		if info.Type == "" {
+			info.Type = "collection"
+		}
+		collections = append(collections, info)
+	})
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name < collections[j].Name
+	})
+	return
+}
+
+// collectMetadata reads the indexes of the collection, they are kept without the fields
+// which depend on the server (the version of the index and the namespace)
+func collectMetadata(session *mgo.Session, namespace string, info collectionInfo) *collectionMetadata {
+	metadata := &collectionMetadata{Type: info.Type, Options: info.Options}
+	if info.isView() {
+		return metadata
+	}
+	dbName, collectionName := splitNamespace(namespace)
+	runCursorCommand(session.DB(dbName), bson.D{{Name: "listIndexes", Value: collectionName}}, func(raw bson.Raw) {
+		spec := bson.D{}
+		if err := raw.Unmarshal(&spec); err != nil {
+			log.Fatalln("Could not read index", err)
+		}
+		var normalized bson.D
+		for _, element := range spec {
+			if element.Name != "v" && element.Name != "ns" {
+				normalized = append(normalized, element)
+			}
+		}
+		metadata.Indexes = append(metadata.Indexes, normalized)
+	})
+	sort.Slice(metadata.Indexes, func(i, j int) bool {
+		return indexName(metadata.Indexes[i]) < indexName(metadata.Indexes[j])
+	})
+	return metadata
+}
+
+// collectAllMetadata reads the metadata of all the monitored collections without scanning their documents
+func (context *context) collectAllMetadata() map[string]*collectionMetadata {
+	metadata := make(map[string]*collectionMetadata)
+	for _, dbName := range context.databases() {
+		for _, info := range listCollections(context.session, dbName) {
+			namespace := dbName + "." + info.Name
+			if strings.HasPrefix(info.Name, "system.") || context.isExcluded(namespace) {
+				continue
+			}
+			metadata[namespace] = collectMetadata(context.session, namespace, info)
+		}
+	}
+	return metadata
+}
+
+// runCursorCommand runs a command answering with a cursor and iterates through all of its batches
+func runCursorCommand(database *mgo.Database, command bson.D, handle func(raw bson.Raw)) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NS         string     `bson:"ns"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	if err := database.Run(command, &result); err != nil {
+		log.Fatalf("Could not run %s on %s: %v", command[0].Name, database.Name, err)
+	}
+	dbName, collectionName := splitNamespace(result.Cursor.NS)
+	if dbName == "" {
+		dbName = database.Name
+	}
+	iter := database.Session.DB(dbName).C(collectionName).NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, nil)
+	raw := bson.Raw{}
+	for iter.Next(&raw) {
+		handle(raw)
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatalf("Could not read the result of %s on %s: %v", command[0].Name, database.Name, err)
+	}
+}
+
+func indexName(index bson.D) string {
+	name, _ := index.Map()["name"].(string)
+	return name
+}
+
+func sameBSON(first interface{}, second interface{}) bool {
+	firstBytes, err := bson.Marshal(bson.M{"v": first})
+	if err != nil {
+		log.Fatalln("Could not Marshal metadata", err)
+	}
+	secondBytes, err := bson.Marshal(bson.M{"v": second})
+	if err != nil {
+		log.Fatalln("Could not Marshal metadata", err)
+	}
+	return bytes.Equal(firstBytes, secondBytes)
+}
+
+// diffMetadata compares the metadata of a collection, nothing is known about the changes when
+// the metadata is missing on either side (e.g. in snapshots taken by older versions)
+func diffMetadata(before *collectionMetadata, after *collectionMetadata) *metadataChanges {
+	if before == nil || after == nil {
+		return nil
+	}
+	changes := &metadataChanges{Before: before, After: after}
+	beforeIndexes := make(map[string]bson.D)
+	for _, index := range before.Indexes {
+		beforeIndexes[indexName(index)] = index
+	}
+	afterIndexes := make(map[string]bson.D)
+	for _, index := range after.Indexes {
+		afterIndexes[indexName(index)] = index
+		if original, ok := beforeIndexes[indexName(index)]; !ok || !sameBSON(original, index) {
+			changes.AddedIndexes = append(changes.AddedIndexes, index)
+		}
+	}
+	for _, index := range before.Indexes {
+		if current, ok := afterIndexes[indexName(index)]; !ok || !sameBSON(current, index) {
+			changes.RemovedIndexes = append(changes.RemovedIndexes, index)
+		}
+	}
+	beforeOptions, afterOptions := before.Options.Map(), after.Options.Map()
+	var names []string
+	for name := range beforeOptions {
+		names = append(names, name)
+	}
+	for name := range afterOptions {
+		if _, ok := beforeOptions[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !sameBSON(beforeOptions[name], afterOptions[name]) {
+			changes.ChangedOptions = append(changes.ChangedOptions, name)
+		}
+	}
+	if len(changes.AddedIndexes) == 0 && len(changes.RemovedIndexes) == 0 && len(changes.ChangedOptions) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// addMetadataChanges puts the changes of the metadata among the changes of the collection, if there are any
+func (diff data) addMetadataChanges(namespace string, changes *metadataChanges) {
+	if changes == nil {
+		return
+	}
+	collectionChanges := diff.collectionChanges(namespace)
+	collectionChanges.MetadataChanges = changes
+	diff[namespace] = collectionChanges
+}
+
+// createdCollection describes a collection which didn't exist before the recording
+func createdCollection(after *collectionMetadata) *metadataChanges {
+	return &metadataChanges{After: after, Created: true, AddedIndexes: withoutDefaultIndex(after)}
+}
+
+// droppedCollection describes a collection which doesn't exist anymore after the recording
+func droppedCollection(before *collectionMetadata) *metadataChanges {
+	return &metadataChanges{Before: before, Dropped: true, RemovedIndexes: withoutDefaultIndex(before)}
+}
+
+func withoutDefaultIndex(metadata *collectionMetadata) (indexes []bson.D) {
+	if metadata == nil {
+		return nil
+	}
+	for _, index := range metadata.Indexes {
+		if indexName(index) != defaultIndex {
+			indexes = append(indexes, index)
+		}
+	}
+	return
+}
+
+// fixedOptions are the changed options which collMod can't change, so they can't be replayed
+func (changes *metadataChanges) fixedOptions() (fixed []string) {
+	for _, name := range changes.ChangedOptions {
+		if !isModifiable(name) {
+			fixed = append(fixed, name)
+		}
+	}
+	return
+}
+
+func isModifiable(option string) bool {
+	for _, name := range modifiableOptions {
+		if name == option {
+			return true
+		}
+	}
+	return false
+}
+
+// replaySteps bring the collection from the state before the recording into the state after it
+func (changes *metadataChanges) replaySteps(collectionName string) metadataSteps {
+	switch {
+	case changes.Dropped:
+		return metadataSteps{Drop: true}
+	case changes.Created:
+		return metadataSteps{Create: shellLiteral(creationOptions(changes.After)), CreateIndexes: indexLiterals(changes.AddedIndexes)}
+	}
+	return metadataSteps{
+		DropIndexes:   indexNames(changes.RemovedIndexes),
+		CreateIndexes: indexLiterals(changes.AddedIndexes),
+		CollMod:       changes.collMod(collectionName, changes.After),
+	}
+}
+
+// cleanSteps bring the collection back into the state before the recording
+func (changes *metadataChanges) cleanSteps(collectionName string) metadataSteps {
+	switch {
+	case changes.Created:
+		return metadataSteps{Drop: true}
+	case changes.Dropped:
+		return metadataSteps{Create: shellLiteral(creationOptions(changes.Before)), CreateIndexes: indexLiterals(changes.RemovedIndexes)}
+	}
+	return metadataSteps{
+		DropIndexes:   indexNames(changes.AddedIndexes),
+		CreateIndexes: indexLiterals(changes.RemovedIndexes),
+		CollMod:       changes.collMod(collectionName, changes.Before),
+	}
+}
+
+// collModCommand gives the changed options the values they have in the target metadata,
+// it is nil when none of the changed options can be changed by collMod
+func (changes *metadataChanges) collModCommand(collectionName string, target *collectionMetadata) bson.D {
+	if len(changes.ChangedOptions) == 0 {
+		return nil
+	}
+	var command bson.D
+	options := target.Options.Map()
+	for _, name := range changes.ChangedOptions {
+		if !isModifiable(name) {
+			continue
+		}
+		value, ok := options[name]
+		if !ok {
+			if value, ok = optionDefaults[name]; !ok {
+				continue
+			}
+		}
+		command = append(command, bson.DocElem{Name: name, Value: value})
+	}
+	if len(command) == 0 {
+		return nil
+	}
+	return append(bson.D{{Name: "collMod", Value: collectionName}}, command...)
+}
+
+// creationOptions are the options the collection (or view) has been created with, none when they aren't known
+func creationOptions(metadata *collectionMetadata) bson.D {
+	if metadata == nil || metadata.Options == nil {
+		return bson.D{}
+	}
+	return metadata.Options
+}
+
+func (changes *metadataChanges) collMod(collectionName string, target *collectionMetadata) string {
+	command := changes.collModCommand(collectionName, target)
+	if command == nil {
+		return ""
+	}
+	return shellLiteral(command)
+}
+
+// manifest holds the changes in the form read back by the replay command
+func (changes *metadataChanges) manifest(collectionName string) *manifestMetadata {
+	metadata := &manifestMetadata{Created: changes.Created, Dropped: changes.Dropped}
+	switch {
+	case changes.Created:
+		metadata.Options = extendedJSON(creationOptions(changes.After))
+	case changes.Dropped:
+		metadata.Options = extendedJSON(creationOptions(changes.Before))
+	}
+	for _, index := range changes.AddedIndexes {
+		metadata.AddedIndexes = append(metadata.AddedIndexes, extendedJSON(index))
+	}
+	for _, index := range changes.RemovedIndexes {
+		metadata.RemovedIndexes = append(metadata.RemovedIndexes, extendedJSON(index))
+	}
+	if command := changes.collModCommand(collectionName, changes.After); command != nil {
+		metadata.ReplayCollMod = extendedJSON(command)
+	}
+	if command := changes.collModCommand(collectionName, changes.Before); command != nil {
+		metadata.CleanCollMod = extendedJSON(command)
+	}
+	return metadata
+}
+
+func indexNames(indexes []bson.D) (names []string) {
+	for _, index := range indexes {
+		names = append(names, strconv.Quote(indexName(index)))
+	}
+	return
+}
+
+func indexLiterals(indexes []bson.D) (literals []string) {
+	for _, index := range indexes {
+		literals = append(literals, shellLiteral(index))
+	}
+	return
+}
+
+// descriptions tell what has been changed, one line per index or option
+func (changes *metadataChanges) descriptions() (descriptions []string) {
+	switch {
+	case changes.Created:
+		descriptions = append(descriptions, fmt.Sprintf("+ %s created with options %s", changes.kind(), extendedJSON(creationOptions(changes.After))))
+	case changes.Dropped:
+		descriptions = append(descriptions, fmt.Sprintf("- %s dropped", changes.kind()))
+	}
+	for _, index := range changes.RemovedIndexes {
+		descriptions = append(descriptions, fmt.Sprintf("- index %s %s", indexName(index), extendedJSON(index)))
+	}
+	for _, index := range changes.AddedIndexes {
+		descriptions = append(descriptions, fmt.Sprintf("+ index %s %s", indexName(index), extendedJSON(index)))
+	}
+	for _, name := range changes.ChangedOptions {
+		descriptions = append(descriptions, fmt.Sprintf("~ option %s: %s -> %s", name,
+			optionJSON(changes.Before.Options.Map(), name), optionJSON(changes.After.Options.Map(), name)))
+	}
+	return
+}
+
+// kind tells whether the created or dropped collection is a view
+func (changes *metadataChanges) kind() string {
+	for _, metadata := range []*collectionMetadata{changes.Before, changes.After} {
+		if metadata != nil && metadata.Type == "view" {
+			return "view"
+		}
+	}
+	return "collection"
+}
+
+func optionJSON(options bson.M, name string) string {
+	value, ok := options[name]
+	if !ok {
+		return "(none)"
+	}
+	return string(extendedJSON(value))
+}
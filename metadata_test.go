@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func index(name string, key bson.D, options ...bson.DocElem) bson.D {
+	return append(bson.D{{Name: "key", Value: key}, {Name: "name", Value: name}}, options...)
+}
+
+func TestMetadataChanges(t *testing.T) {
+	validator := bson.D{{Name: "$jsonSchema", Value: bson.D{{Name: "required", Value: []interface{}{"email"}}}}}
+	before := &collectionMetadata{
+		Type:    "collection",
+		Options: bson.D{{Name: "capped", Value: false}},
+		Indexes: []bson.D{
+			index("_id_", bson.D{{Name: "_id", Value: 1}}),
+			index("created_1", bson.D{{Name: "created", Value: 1}}),
+			index("email_1", bson.D{{Name: "email", Value: 1}}),
+		},
+	}
+	after := &collectionMetadata{
+		Type:    "collection",
+		Options: bson.D{{Name: "capped", Value: true}, {Name: "validator", Value: validator}},
+		Indexes: []bson.D{
+			index("_id_", bson.D{{Name: "_id", Value: 1}}),
+			index("created_1", bson.D{{Name: "created", Value: 1}}, bson.DocElem{Name: "expireAfterSeconds", Value: 3600}),
+			index("name_1", bson.D{{Name: "name", Value: 1}}),
+		},
+	}
+
+	changes := diffMetadata(before, after)
+	if changes == nil {
+		t.Fatal("Expected metadata changes")
+	}
+	if names := indexNames(changes.AddedIndexes); !reflect.DeepEqual(names, []string{`"created_1"`, `"name_1"`}) {
+		t.Error("Unexpected added indexes", names)
+	}
+	if names := indexNames(changes.RemovedIndexes); !reflect.DeepEqual(names, []string{`"created_1"`, `"email_1"`}) {
+		t.Error("Unexpected removed indexes", names)
+	}
+	if !reflect.DeepEqual(changes.ChangedOptions, []string{"capped", "validator"}) || !reflect.DeepEqual(changes.fixedOptions(), []string{"capped"}) {
+		t.Error("Unexpected changed options", changes.ChangedOptions)
+	}
+
+	replay := changes.replaySteps("users")
+	if replay.CollMod != `{"collMod": "users", "validator": {"$jsonSchema": {"required": ["email"]}}}` {
+		t.Error("Unexpected collMod of the replay", replay.CollMod)
+	}
+	if replay.CreateIndexes[1] != `{"key": {"name": NumberInt(1)}, "name": "name_1"}` {
+		t.Error("Unexpected created index", replay.CreateIndexes)
+	}
+	clean := changes.cleanSteps("users")
+	if clean.CollMod != `{"collMod": "users", "validator": {}}` {
+		t.Error("Expected validator to be removed by the clean script, but got", clean.CollMod)
+	}
+	if !reflect.DeepEqual(clean.DropIndexes, []string{`"created_1"`, `"name_1"`}) || len(clean.CreateIndexes) != 2 {
+		t.Error("Unexpected index steps of the clean script", clean)
+	}
+}
+
+func TestUnchangedOrUnknownMetadata(t *testing.T) {
+	metadata := &collectionMetadata{Type: "collection", Indexes: []bson.D{index("_id_", bson.D{{Name: "_id", Value: 1}})}}
+	same := &collectionMetadata{Type: "collection", Indexes: []bson.D{index("_id_", bson.D{{Name: "_id", Value: 1}})}}
+	if changes := diffMetadata(metadata, same); changes != nil {
+		t.Error("Expected no changes, but got", changes)
+	}
+	if changes := diffMetadata(nil, metadata); changes != nil {
+		t.Error("Expected no changes when the metadata isn't known, but got", changes)
+	}
+}
+
+func TestMetadataChangesOfSnapshots(t *testing.T) {
+	before, after := newCollectionIds(), newCollectionIds()
+	before.Metadata = &collectionMetadata{Type: "collection"}
+	after.Metadata = &collectionMetadata{Type: "collection", Indexes: []bson.D{index("email_1", bson.D{{Name: "email", Value: 1}})}}
+
+	diff := (&context{}).diffData(data{"test.users": before}, data{"test.users": after})
+	if diff["test.users"].MetadataChanges == nil || len(diff["test.users"].MetadataChanges.AddedIndexes) != 1 {
+		t.Error("Expected added index, but got", diff)
+	}
+}
+
+func TestCreatedAndDroppedCollectionSteps(t *testing.T) {
+	metadata := &collectionMetadata{
+		Type:    "collection",
+		Options: bson.D{{Name: "capped", Value: true}, {Name: "size", Value: 4096}},
+		Indexes: []bson.D{index("_id_", bson.D{{Name: "_id", Value: 1}}), index("email_1", bson.D{{Name: "email", Value: 1}})},
+	}
+
+	created := createdCollection(metadata)
+	replay := created.replaySteps("users")
+	if replay.Create != `{"capped": true, "size": NumberInt(4096)}` || !reflect.DeepEqual(replay.CreateIndexes, []string{`{"key": {"email": NumberInt(1)}, "name": "email_1"}`}) {
+		t.Error("Expected the collection to be created with its options and indexes, but got", replay)
+	}
+	if clean := created.cleanSteps("users"); !clean.Drop || clean.Create != "" {
+		t.Error("Expected the created collection to be dropped by the clean script, but got", clean)
+	}
+
+	dropped := droppedCollection(metadata)
+	if replay := dropped.replaySteps("users"); !replay.Drop {
+		t.Error("Expected the collection to be dropped by the replay, but got", replay)
+	}
+	if clean := dropped.cleanSteps("users"); clean.Create == "" || len(clean.CreateIndexes) != 1 {
+		t.Error("Expected the dropped collection to be created again by the clean script, but got", clean)
+	}
+	if manifest := dropped.manifest("users"); !manifest.Dropped || string(manifest.Options) != `{"capped":true,"size":4096}` {
+		t.Error("Unexpected manifest of the dropped collection", manifest)
+	}
+	if view := createdCollection(&collectionMetadata{Type: "view"}); view.descriptions()[0] != "+ view created with options {}" {
+		t.Error("Unexpected description of the created view", view.descriptions())
+	}
+}
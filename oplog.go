@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.Raw            `bson:"o"`
+	Object2   bson.Raw            `bson:"o2"`
+}
+
+// documentHistory remembers what happened to a single document during the recording:
+// whether it existed before the first operation and whether it exists after the last one
+type documentHistory struct {
+	existedBefore bool
+	exists        bool
+}
+
+type oplogRecorder struct {
+	context     *context
+	session     *mgo.Session
+	start       bson.MongoTimestamp
+	last        bson.MongoTimestamp
+	histories   map[string]map[interface{}]*documentHistory
+	pattern     *regexp.Regexp
+	stopping    chan bool
+	checkpoints chan checkpointRequest
+	done        chan bool
+}
+
+// checkpointRequest asks for the changes recorded so far, which are given back once the oplog
+// has been drained; with reset the recording continues with a clean history
+type checkpointRequest struct {
+	reset bool
+	reply chan data
+}
+
+// startOplogRecording remembers the current position of the oplog and starts tailing it
+// in the background; all the operations done on the monitored DB are collected until
+// stop is called
+func (context *context) startOplogRecording() (recorder *oplogRecorder) {
+	recorder = &oplogRecorder{
+		context:     context,
+		session:     context.session.Copy(),
+		histories:   make(map[string]map[interface{}]*documentHistory),
+		stopping:    make(chan bool, 1),
+		checkpoints: make(chan checkpointRequest, 1),
+		done:        make(chan bool),
+	}
+	recorder.start = recorder.lastTimestamp()
+	recorder.last = recorder.start
+	fmt.Println(blueFormat("Recording oplog from timestamp ") + redFormat(fmt.Sprintf("%v", recorder.start)))
+	go recorder.tail()
+	return
+}
+
+func (recorder *oplogRecorder) oplog() *mgo.Collection {
+	return recorder.session.DB("local").C("oplog.rs")
+}
+
+func (recorder *oplogRecorder) lastTimestamp() bson.MongoTimestamp {
+	entry := oplogEntry{}
+	if err := recorder.oplog().Find(nil).Sort("-$natural").One(&entry); err != nil {
+		log.Fatalln("Could not read the oplog, is the server running as a replica set member?", err)
+	}
+	return entry.Timestamp
+}
+
+func (recorder *oplogRecorder) tail() {
+	defer close(recorder.done)
+	stopping := false
+	var checkpoint *checkpointRequest
+	for {
+		query := bson.M{
+			"ts": bson.M{"$gt": recorder.last},
+			"$or": []bson.M{
+				{"ns": bson.M{"$regex": recorder.namespacePattern()}},
+				// transactions are written to the oplog as applyOps commands of the admin DB
+				{"ns": "admin.$cmd", "o.applyOps": bson.M{"$exists": true}},
+			},
+		}
+		iter := recorder.oplog().Find(query).LogReplay().Tail(time.Second)
+		entry := oplogEntry{}
+		dead := false
+		for !dead {
+			for iter.Next(&entry) {
+				recorder.record(entry)
+				recorder.last = entry.Timestamp
+				entry = oplogEntry{}
+			}
+			if iter.Err() != nil {
+				break
+			}
+			// the server doesn't keep the cursor open when its query hasn't matched anything yet (e.g. on a quiet DB),
+			// it is queried again after a while, but the requests have to be answered in the meantime as well
+			dead = !iter.Timeout()
+			if stopping {
+				// nothing new has arrived since the stop was requested
+				if err := iter.Close(); err != nil {
+					log.Fatalln("Could not close oplog iterator", err)
+				}
+				return
+			}
+			if checkpoint != nil {
+				checkpoint.reply <- recorder.takeChanges(checkpoint.reset)
+				checkpoint = nil
+			}
+			delay := time.Duration(0)
+			if dead {
+				delay = deadCursorDelay
+			}
+			stopping, checkpoint = recorder.awaitRequest(delay)
+		}
+		if err := iter.Close(); err != nil {
+			log.Fatalln("Could not tail the oplog", err)
+		}
+	}
+}
+
+// deadCursorDelay is how long to wait before querying the oplog again when the server has closed the cursor
+const deadCursorDelay = time.Second
+
+// awaitRequest waits up to the delay for a stop or a checkpoint request, without any delay it only checks
+// whether one has arrived. The requests are answered only once the oplog has been drained again
+func (recorder *oplogRecorder) awaitRequest(delay time.Duration) (stop bool, checkpoint *checkpointRequest) {
+	if delay == 0 {
+		select {
+		case <-recorder.stopping:
+			return true, nil
+		case request := <-recorder.checkpoints:
+			return false, &request
+		default:
+			return false, nil
+		}
+	}
+	select {
+	case <-recorder.stopping:
+		return true, nil
+	case request := <-recorder.checkpoints:
+		return false, &request
+	case <-time.After(delay):
+		return false, nil
+	}
+}
+
+// namespacePattern matches the namespaces of all the monitored DBs
+func (recorder *oplogRecorder) namespacePattern() string {
+	if recorder.context.allDbs {
+		return `^[^.]+\.`
+	}
+	var quoted []string
+	for _, dbName := range recorder.context.databases() {
+		quoted = append(quoted, regexp.QuoteMeta(dbName))
+	}
+	return "^(" + strings.Join(quoted, "|") + `)\.`
+}
+
+func (recorder *oplogRecorder) record(entry oplogEntry) {
+	if entry.Operation == "c" {
+		recorder.recordCommand(entry)
+		return
+	}
+	dbName, collectionName := splitNamespace(entry.Namespace)
+	if systemDatabases[dbName] && recorder.context.allDbs {
+		return
+	}
+	if strings.HasPrefix(collectionName, "system.") || recorder.context.isExcluded(entry.Namespace) {
+		return
+	}
+	var idHolder bson.Raw
+	switch entry.Operation {
+	case "i", "d":
+		idHolder = entry.Object
+	case "u":
+		idHolder = entry.Object2
+	default:
+		return
+	}
+	collItem := collectionItem{}
+	if err := idHolder.Unmarshal(&collItem); err != nil {
+		log.Fatalln("Could not read document id from the oplog", err)
+	}
+	histories, ok := recorder.histories[entry.Namespace]
+	if !ok {
+		histories = make(map[interface{}]*documentHistory)
+		recorder.histories[entry.Namespace] = histories
+	}
+	id := collItem.key()
+	history, ok := histories[id]
+	if !ok {
+		history = &documentHistory{existedBefore: entry.Operation != "i"}
+		histories[id] = history
+	}
+	history.exists = entry.Operation != "d"
+}
+
+// recordCommand unpacks the operations of transactions (and of applyOps commands in general), the other
+// commands change the collections themselves, whose metadata is compared at the end of the recording instead
+func (recorder *oplogRecorder) recordCommand(entry oplogEntry) {
+	command := struct {
+		ApplyOps []oplogEntry `bson:"applyOps"`
+	}{}
+	if err := entry.Object.Unmarshal(&command); err != nil {
+		log.Fatalln("Could not read command from the oplog", err)
+	}
+	for _, operation := range command.ApplyOps {
+		if recorder.monitors(operation.Namespace) {
+			recorder.record(operation)
+		}
+	}
+}
+
+// monitors tells whether the namespace belongs to one of the monitored DBs
+func (recorder *oplogRecorder) monitors(namespace string) bool {
+	if recorder.pattern == nil {
+		recorder.pattern = regexp.MustCompile(recorder.namespacePattern())
+	}
+	return recorder.pattern.MatchString(namespace)
+}
+
+// stop waits until the oplog has been drained of all the operations done up to this moment
+// and gives back the changes in the same form as diffData does
+func (recorder *oplogRecorder) stop() data {
+	recorder.stopping <- true
+	<-recorder.done
+	recorder.session.Close()
+	changes := recorder.changes()
+	recorder.context.dropUnmatched(changes)
+	return changes
+}
+
+// checkpoint waits until the oplog has been drained like stop does, but the recording goes on
+func (recorder *oplogRecorder) checkpoint(reset bool) data {
+	request := checkpointRequest{reset: reset, reply: make(chan data)}
+	recorder.checkpoints <- request
+	changes := <-request.reply
+	recorder.context.dropUnmatched(changes)
+	return changes
+}
+
+func (recorder *oplogRecorder) takeChanges(reset bool) data {
+	changes := recorder.changes()
+	if reset {
+		recorder.histories = make(map[string]map[interface{}]*documentHistory)
+	}
+	return changes
+}
+
+func (recorder *oplogRecorder) changes() data {
+	changes := data{}
+	for namespace, histories := range recorder.histories {
+		for id, history := range histories {
+			switch {
+			case history.existedBefore && history.exists:
+				changes.collectionChanges(namespace).Modified[id] = true
+			case history.existedBefore:
+				changes.collectionChanges(namespace).Removed[id] = true
+			case history.exists:
+				changes.collectionChanges(namespace).Ids[id] = true
+			}
+		}
+	}
+	return changes
+}
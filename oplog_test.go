@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOplogOperationsAreFoldedIntoChanges(t *testing.T) {
+	recorder := &oplogRecorder{
+		context:   &context{dbName: "test", excludes: "ignored"},
+		histories: make(map[string]map[interface{}]*documentHistory),
+	}
+	recorder.record(oplogEntryFor(t, "i", "test.diffTest", "added", nil))
+	recorder.record(oplogEntryFor(t, "u", "test.diffTest", bson.M{"$set": bson.M{"v": 1}}, "modified"))
+	recorder.record(oplogEntryFor(t, "d", "test.diffTest", "removed", nil))
+	recorder.record(oplogEntryFor(t, "i", "test.diffTest", "temporary", nil))
+	recorder.record(oplogEntryFor(t, "d", "test.diffTest", "temporary", nil))
+	recorder.record(oplogEntryFor(t, "i", "test.ignored", "excluded", nil))
+	recorder.record(oplogEntryFor(t, "i", "test.system.js", "system", nil))
+
+	changes := recorder.changes()
+
+	if len(changes) != 1 {
+		t.Fatal("Expected changes only in one collection, but got", changes)
+	}
+	diffTest := changes["test.diffTest"]
+	if len(diffTest.Ids) != 1 || !diffTest.Ids["added"] {
+		t.Error("Expected one added document, but got", diffTest.Ids)
+	}
+	if len(diffTest.Modified) != 1 || !diffTest.Modified["modified"] {
+		t.Error("Expected one modified document, but got", diffTest.Modified)
+	}
+	if len(diffTest.Removed) != 1 || !diffTest.Removed["removed"] {
+		t.Error("Expected one removed document, but got", diffTest.Removed)
+	}
+}
+
+func TestOplogModifiedDocumentsAreNotCleaned(t *testing.T) {
+	recorder := &oplogRecorder{
+		context:   &context{dbName: "test"},
+		histories: make(map[string]map[interface{}]*documentHistory),
+	}
+	recorder.record(oplogEntryFor(t, "i", "test.diffTest", "added", nil))
+	recorder.record(oplogEntryFor(t, "u", "test.diffTest", bson.M{"$set": bson.M{"v": 1}}, "modified"))
+	changes := recorder.changes()
+
+	change := collectionChange{CollectionName: "diffTest"}
+	manifestChange := manifestCollection{Database: "test", Name: "diffTest"}
+	listChangedIds(changes["test.diffTest"], &change, &manifestChange, false, false)
+	if len(manifestChange.Modified) != 1 || len(manifestChange.restorable()) != 0 {
+		t.Error("Expected the modified document not to be removed when cleaning, but got", manifestChange)
+	}
+	templateData := &templateData{Databases: []databaseChanges{{DbName: "test", CollectionChanges: []collectionChange{change}}}}
+
+	clean := expandTemplate(t, "data/template_js", templateData)
+	if !strings.Contains(clean, `remove({"_id":"added"})`) || strings.Contains(clean, `"modified"`) {
+		t.Error("Expected the clean script to remove only the added document, but got", clean)
+	}
+	replay := expandTemplate(t, "data/template_replay_js", templateData)
+	if !strings.Contains(replay, `remove({"_id":"modified"})`) {
+		t.Error("Expected the replay script to replace the modified document, but got", replay)
+	}
+}
+
+func expandTemplate(t *testing.T, filename string, data interface{}) string {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal("Could not read template", err)
+	}
+	var expanded bytes.Buffer
+	if err := template.Must(template.New(filename).Parse(string(contents))).Execute(&expanded, data); err != nil {
+		t.Fatal("Could not expand template", err)
+	}
+	return expanded.String()
+}
+
+// oplogEntryFor makes an entry with the document id placed where the server puts it:
+// in "o" for inserts and deletes, in "o2" for updates
+func oplogEntryFor(t *testing.T, operation string, namespace string, object interface{}, updatedID interface{}) oplogEntry {
+	toRaw := func(value interface{}) bson.Raw {
+		bytes, err := bson.Marshal(value)
+		if err != nil {
+			t.Fatal("Could not marshal oplog entry part", err)
+		}
+		return bson.Raw{Kind: 0x03, Data: bytes}
+	}
+	entry := oplogEntry{Operation: operation, Namespace: namespace}
+	if operation == "u" {
+		entry.Object = toRaw(object)
+		entry.Object2 = toRaw(bson.M{"_id": updatedID})
+	} else {
+		entry.Object = toRaw(bson.M{"_id": object})
+	}
+	return entry
+}
+
+func TestOplogCheckpointStartsCleanHistory(t *testing.T) {
+	recorder := &oplogRecorder{
+		context:   &context{dbName: "test"},
+		histories: make(map[string]map[interface{}]*documentHistory),
+	}
+	recorder.record(oplogEntryFor(t, "i", "test.diffTest", "first", nil))
+	first := recorder.takeChanges(true)
+	recorder.record(oplogEntryFor(t, "u", "test.diffTest", bson.M{"$set": bson.M{"v": 1}}, "first"))
+	second := recorder.takeChanges(true)
+
+	if !first["test.diffTest"].Ids["first"] || len(first["test.diffTest"].Modified) != 0 {
+		t.Error("Expected document to be added in the first part, but got", first)
+	}
+	if !second["test.diffTest"].Modified["first"] || len(second["test.diffTest"].Ids) != 0 {
+		t.Error("Expected document to be modified in the second part, but got", second)
+	}
+}
+
+func TestOplogDocumentsOfDroppedCollections(t *testing.T) {
+	recorder := &oplogRecorder{
+		context:   &context{dbName: "test"},
+		histories: make(map[string]map[interface{}]*documentHistory),
+	}
+	recorder.record(oplogEntryFor(t, "i", "test.dropped", "added", nil))
+	recorder.record(oplogEntryFor(t, "u", "test.dropped", bson.M{"$set": bson.M{"v": 1}}, "modified"))
+	recorder.record(oplogEntryFor(t, "d", "test.dropped", "removed", nil))
+	recorder.record(oplogEntryFor(t, "i", "test.temporary", "added", nil))
+	recorder.record(oplogEntryFor(t, "i", "test.kept", "added", nil))
+	existing := &collectionMetadata{Type: "collection"}
+
+	changes := recorder.changes()
+	changes.addCollectionChanges(
+		map[string]*collectionMetadata{"test.dropped": existing, "test.kept": existing},
+		map[string]*collectionMetadata{"test.kept": existing})
+
+	if _, ok := changes["test.temporary"]; ok {
+		t.Error("Expected no changes of a collection created and dropped during the recording, but got", changes["test.temporary"])
+	}
+	dropped := changes["test.dropped"]
+	if dropped.MetadataChanges == nil || !dropped.MetadataChanges.Dropped {
+		t.Error("Expected the collection to be dropped, but got", dropped.MetadataChanges)
+	}
+	if len(dropped.Ids) != 0 || len(dropped.Modified) != 0 {
+		t.Error("Expected nothing to be exported from a dropped collection, but got", dropped.Ids, dropped.Modified)
+	}
+	if len(dropped.Removed) != 2 || !dropped.Removed["modified"] || !dropped.Removed["removed"] {
+		t.Error("Expected the modified and removed documents to be removed, but got", dropped.Removed)
+	}
+	if !changes["test.kept"].Ids["added"] {
+		t.Error("Expected the added document of an existing collection, but got", changes["test.kept"])
+	}
+}
+
+func TestOplogTransactionsAreUnpacked(t *testing.T) {
+	recorder := &oplogRecorder{
+		context:   &context{dbName: "test"},
+		histories: make(map[string]map[interface{}]*documentHistory),
+	}
+	operations := []oplogEntry{
+		oplogEntryFor(t, "i", "test.diffTest", "added", nil),
+		oplogEntryFor(t, "u", "test.diffTest", bson.M{"$set": bson.M{"v": 1}}, "modified"),
+		oplogEntryFor(t, "i", "other.diffTest", "elsewhere", nil),
+	}
+	var applyOps []bson.M
+	for _, operation := range operations {
+		op := bson.M{"op": operation.Operation, "ns": operation.Namespace, "o": operation.Object}
+		if operation.Object2.Kind != 0 {
+			op["o2"] = operation.Object2
+		}
+		applyOps = append(applyOps, op)
+	}
+	transaction, err := bson.Marshal(bson.M{"applyOps": applyOps})
+	if err != nil {
+		t.Fatal("Could not marshal transaction", err)
+	}
+	recorder.record(oplogEntry{Operation: "c", Namespace: "admin.$cmd", Object: bson.Raw{Kind: 0x03, Data: transaction}})
+	recorder.record(oplogEntryFor(t, "c", "test.$cmd", "ignored", nil))
+
+	changes := recorder.changes()
+	if len(changes) != 1 || !changes["test.diffTest"].Ids["added"] || !changes["test.diffTest"].Modified["modified"] {
+		t.Error("Expected the operations of the transaction in the monitored DB, but got", changes)
+	}
+}
+
+func TestOplogRequestsAreAwaited(t *testing.T) {
+	recorder := &oplogRecorder{stopping: make(chan bool, 1), checkpoints: make(chan checkpointRequest, 1)}
+	if stop, checkpoint := recorder.awaitRequest(0); stop || checkpoint != nil {
+		t.Error("Expected no request, but got", stop, checkpoint)
+	}
+	recorder.checkpoints <- checkpointRequest{reset: true}
+	if stop, checkpoint := recorder.awaitRequest(time.Minute); stop || checkpoint == nil || !checkpoint.reset {
+		t.Error("Expected the checkpoint request, but got", stop, checkpoint)
+	}
+	go func() {
+		recorder.stopping <- true
+	}()
+	if stop, _ := recorder.awaitRequest(time.Minute); !stop {
+		t.Error("Expected the stop request while waiting")
+	}
+}
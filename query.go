@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	extjson "github.com/mongodb/mongo-tools/common/json"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// collectionQueries holds the query filters which limit the recorded documents, they are keyed
+// either by the collection name alone or by the namespace, which has priority
+type collectionQueries map[string]bson.D
+
+// String is a part of flag.Value, so that -query can be given more times
+func (queries collectionQueries) String() string {
+	var values []string
+	for collection, query := range queries {
+		values = append(values, fmt.Sprintf("%s=%v", collection, query))
+	}
+	sort.Strings(values)
+	return strings.Join(values, " ")
+}
+
+// Set is a part of flag.Value, it accepts the collection and its query in the form collection={...}
+func (queries collectionQueries) Set(value string) error {
+	keyValue := strings.SplitN(value, "=", 2)
+	if len(keyValue) != 2 || keyValue[0] == "" {
+		return fmt.Errorf("query must be given as collection={...}: %s", value)
+	}
+	query, err := parseQuery([]byte(keyValue[1]))
+	if err != nil {
+		return fmt.Errorf("invalid query for %s: %v", keyValue[0], err)
+	}
+	queries[keyValue[0]] = query
+	return nil
+}
+
+// readFile reads the queries from a JSON file holding an object with a query per collection,
+// e.g. {"users": {"tenantId": "demo"}, "billing.invoices": {"tenant": "demo"}}
+func (queries collectionQueries) readFile(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	document, err := parseQuery(contents)
+	if err != nil {
+		return err
+	}
+	for _, element := range document {
+		query, ok := element.Value.(bson.D)
+		if !ok {
+			return fmt.Errorf("query for %s must be a document", element.Name)
+		}
+		queries[element.Name] = query
+	}
+	return nil
+}
+
+// parseQuery understands queries in the MongoDB Extended JSON format, so that e.g. {"$oid": "..."} can be used
+func parseQuery(text []byte) (bson.D, error) {
+	query, err := extjson.UnmarshalBsonD(text)
+	if err != nil {
+		return nil, err
+	}
+	return bsonutil.GetExtendedBsonD(query)
+}
+
+// queryFor gives back the query which should be used to find the documents of the namespace
+func (queries collectionQueries) queryFor(namespace string) interface{} {
+	if query, ok := queries[namespace]; ok {
+		return query
+	}
+	_, collection := splitNamespace(namespace)
+	if query, ok := queries[collection]; ok {
+		return query
+	}
+	return nil
+}
+
+// dropUnmatched leaves out the added and modified documents which don't match the query of their
+// collection (anymore); the removed ones can't be checked since their documents are gone
+func (context *context) dropUnmatched(changes data) {
+	for namespace, ids := range changes {
+		query := context.queries.queryFor(namespace)
+		if query == nil {
+			continue
+		}
+		for _, changed := range []map[interface{}]bool{ids.Ids, ids.Modified} {
+			matching := context.matchingIds(namespace, changed, query)
+			for id := range changed {
+				if !matching[id] {
+					delete(changed, id)
+				}
+			}
+		}
+	}
+}
+
+// keepOutOfScope records the removed documents which still exist as modified: they have only stopped
+// matching the query of their collection, so the replay mustn't remove them, while the clean script
+// restores their original versions
+func (context *context) keepOutOfScope(changes data) {
+	for namespace, ids := range changes {
+		if context.queries.queryFor(namespace) == nil {
+			continue
+		}
+		for id := range context.matchingIds(namespace, ids.Removed, nil) {
+			delete(ids.Removed, id)
+			ids.Modified[id] = true
+		}
+	}
+}
+
+// matchingIds gives back which of the documents with the given ids match the query, or which of them exist
+// when there is no query, using a query per exportBatchSize ids
+func (context *context) matchingIds(namespace string, ids map[interface{}]bool, query interface{}) map[interface{}]bool {
+	var values []interface{}
+	for id := range ids {
+		values = append(values, idValue(id))
+	}
+	matching := make(map[interface{}]bool)
+	for start := 0; start < len(values); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		var selector interface{} = bson.M{"_id": bson.M{"$in": values[start:end]}}
+		if query != nil {
+			selector = bson.M{"$and": []interface{}{selector, query}}
+		}
+		iter := context.collection(namespace).Find(selector).Select(bson.M{"_id": 1}).Iter()
+		item := collectionItem{}
+		for iter.Next(&item) {
+			matching[item.key()] = true
+		}
+		if err := iter.Close(); err != nil {
+			log.Fatalf("Could not check query of %s: %v", namespace, err)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQueryFlag(t *testing.T) {
+	queries := make(collectionQueries)
+	if err := queries.Set(`users={"tenantId": "demo", "owner": {"$oid": "5a0000000000000000000001"}}`); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "tenantId", Value: "demo"}, {Name: "owner", Value: bson.ObjectIdHex("5a0000000000000000000001")}}
+	if query := queries.queryFor("test.users"); !reflect.DeepEqual(query, expected) {
+		t.Errorf("Expected query %v, but got %v", expected, query)
+	}
+	if query := queries.queryFor("test.invoices"); query != nil {
+		t.Errorf("Collection without a query got %v", query)
+	}
+	if err := queries.Set(`users`); err == nil {
+		t.Error("Query without a collection has been accepted")
+	}
+	if err := queries.Set(`users={tenantId:`); err == nil {
+		t.Error("Invalid query has been accepted")
+	}
+}
+
+func TestQueryFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString(`{"users": {"tenantId": "demo"}, "billing.users": {"tenant": "other"}}`)
+	_ = file.Close()
+
+	queries := make(collectionQueries)
+	if err := queries.readFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if query := queries.queryFor("test.users"); !reflect.DeepEqual(query, bson.D{{Name: "tenantId", Value: "demo"}}) {
+		t.Errorf("Query by the collection name hasn't been used: %v", query)
+	}
+	if query := queries.queryFor("billing.users"); !reflect.DeepEqual(query, bson.D{{Name: "tenant", Value: "other"}}) {
+		t.Errorf("Query by the namespace should have priority: %v", query)
+	}
+}
+
+func TestDocumentLeavingQueryIsModified(t *testing.T) {
+	preFile := testFile(t, "test_query_pre", `
+			db.diffTest.remove({"_id": {"$in": ["leaving", "removed"]}});
+			db.diffTest.insert({"_id": "leaving", "tenantId": "demo"});
+			db.diffTest.insert({"_id": "removed", "tenantId": "demo"});
+		`)
+	postFile := testFile(t, "test_query_post", `
+			db.diffTest.update({"_id": "leaving"}, {"$set": {"tenantId": "other"}});
+			db.diffTest.remove({"_id": "removed"});
+		`)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+	context.queries = make(collectionQueries)
+	if err := context.queries.Set(`diffTest={"tenantId": "demo"}`); err != nil {
+		t.Fatal("Could not set the query", err)
+	}
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	diffData := context.diffData(beforeData, context.collectData(false))
+	context.keepOutOfScope(diffData)
+
+	diffTest := diffData["test.diffTest"]
+	if !diffTest.Modified["leaving"] || diffTest.Removed["leaving"] || !diffTest.Removed["removed"] {
+		t.Error("Expected the document leaving the query to be modified, but got", diffTest)
+	}
+}
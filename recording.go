@@ -0,0 +1,84 @@
+package main
+
+// recording collects the changes done on the DB either by scanning it or by tailing the oplog;
+// checkpoints split it into parts, each one holding the changes done since the previous one
+type recording struct {
+	context  *context
+	before   data
+	recorder *oplogRecorder
+	// metadata is read when tailing the oplog, since the oplog entries of the commands aren't followed
+	metadata map[string]*collectionMetadata
+}
+
+func (context *context) startRecording(useOplog bool) *recording {
+	if useOplog {
+		return &recording{context: context, metadata: context.collectAllMetadata(), recorder: context.startOplogRecording()}
+	}
+	return &recording{context: context, before: context.collectData(true)}
+}
+
+// changes gives back the changes done since the start or the last checkpoint. With checkpoint
+// set the next call gives back only the changes done after this one
+func (recording *recording) changes(checkpoint bool) data {
+	if recording.recorder != nil {
+		return recording.withMetadataChanges(recording.recorder.checkpoint(checkpoint), checkpoint)
+	}
+	after := recording.context.collectData(checkpoint)
+	changes := recording.context.diffData(recording.before, after)
+	recording.context.keepOutOfScope(changes)
+	if checkpoint {
+		recording.before = after
+	}
+	return changes
+}
+
+// stop gives back the changes done since the start or the last checkpoint and ends the recording
+func (recording *recording) stop() data {
+	if recording.recorder != nil {
+		return recording.withMetadataChanges(recording.recorder.stop(), false)
+	}
+	return recording.changes(false)
+}
+
+// withMetadataChanges adds the changes of the metadata done since the start or the last checkpoint
+func (recording *recording) withMetadataChanges(changes data, checkpoint bool) data {
+	after := recording.context.collectAllMetadata()
+	changes.addCollectionChanges(recording.metadata, after)
+	if checkpoint {
+		recording.metadata = after
+	}
+	return changes
+}
+
+// addCollectionChanges adds the changes between the metadata of the collections at the start and at the end
+// of the recorded oplog. The documents of a collection which doesn't exist at the end can't be exported:
+// the added ones are gone for good, while the modified ones existed before and are removed with the collection
+func (diff data) addCollectionChanges(before map[string]*collectionMetadata, after map[string]*collectionMetadata) {
+	for namespace, metadata := range after {
+		if beforeMetadata, ok := before[namespace]; ok {
+			diff.addMetadataChanges(namespace, diffMetadata(beforeMetadata, metadata))
+		} else {
+			diff.addMetadataChanges(namespace, createdCollection(metadata))
+		}
+	}
+	for namespace, metadata := range before {
+		if _, ok := after[namespace]; !ok {
+			diff.addMetadataChanges(namespace, droppedCollection(metadata))
+		}
+	}
+	for namespace, ids := range diff {
+		if _, ok := after[namespace]; ok {
+			continue
+		}
+		for id := range ids.Modified {
+			ids.Removed[id] = true
+		}
+		ids.Ids, ids.Modified = make(map[interface{}]bool), make(map[interface{}]bool)
+		if len(ids.Removed) == 0 && ids.MetadataChanges == nil {
+			// the collection has been created and dropped during the recording
+			delete(diff, namespace)
+		} else {
+			diff[namespace] = ids
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	extjson "github.com/mongodb/mongo-tools/common/json"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// replayManifest describes the generated files in a form that can be read back by the replay
+// command, the ids are kept in the MongoDB Extended JSON format so that their types are preserved
+type replayManifest struct {
+	DbName      string               `json:"db"`
+	Collections []manifestCollection `json:"collections"`
+}
+
+type manifestCollection struct {
+	Database    string            `json:"database"`
+	Name        string            `json:"name"`
+	ImportFile  string            `json:"importFile"`
+	RestoreFile string            `json:"restoreFile,omitempty"`
+	Added       []json.RawMessage `json:"added,omitempty"`
+	Modified    []json.RawMessage `json:"modified,omitempty"`
+	Removed     []json.RawMessage `json:"removed,omitempty"`
+	// Unrestorable are the modified documents whose originals haven't been kept, cleaning leaves them as they are
+	Unrestorable []json.RawMessage `json:"unrestorable,omitempty"`
+	Metadata     *manifestMetadata `json:"metadata,omitempty"`
+	Before       *startingPoint    `json:"before,omitempty"`
+}
+
+// manifestMetadata holds the changes of the indexes and options, the collMod commands give
+// the changed options their values after (replay) and before (clean) the recording. Options
+// are the ones a created or dropped collection has to be created with
+type manifestMetadata struct {
+	Created        bool              `json:"created,omitempty"`
+	Dropped        bool              `json:"dropped,omitempty"`
+	Options        json.RawMessage   `json:"options,omitempty"`
+	AddedIndexes   []json.RawMessage `json:"addedIndexes,omitempty"`
+	RemovedIndexes []json.RawMessage `json:"removedIndexes,omitempty"`
+	ReplayCollMod  json.RawMessage   `json:"replayCollMod,omitempty"`
+	CleanCollMod   json.RawMessage   `json:"cleanCollMod,omitempty"`
+}
+
+// indexNotFound is the error code of dropIndexes when there is no such index
+const indexNotFound = 27
+
+func manifestFilename(prefix string) string {
+	return prefix + ".json"
+}
+
+func (manifest *replayManifest) write(filename string) {
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalln("Could not Marshal replay manifest", err)
+	}
+	if err := ioutil.WriteFile(filename, out, 0600); err != nil {
+		log.Fatalf("Could not save replay manifest %s: %v", filename, err)
+	}
+}
+
+// moveTo makes the changes recorded in the main DB of the recording apply to another DB
+func (manifest *replayManifest) moveTo(dbName string) {
+	for i := range manifest.Collections {
+		if manifest.Collections[i].Database == manifest.DbName {
+			manifest.Collections[i].Database = dbName
+		}
+	}
+	manifest.DbName = dbName
+}
+
+func (change manifestCollection) namespace() string {
+	return change.Database + "." + change.Name
+}
+
+// restorable gives back the modified documents whose originals have been kept
+func (change manifestCollection) restorable() (ids []json.RawMessage) {
+	unrestorable := make(map[string]bool)
+	for _, id := range change.Unrestorable {
+		unrestorable[string(id)] = true
+	}
+	for _, id := range change.Modified {
+		if !unrestorable[string(id)] {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+func readManifest(filename string) (manifest replayManifest) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("Could not read replay manifest %s: %v", filename, err)
+	}
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		log.Fatalf("Could not parse replay manifest %s: %v", filename, err)
+	}
+	for i := range manifest.Collections {
+		if manifest.Collections[i].Database == "" {
+			manifest.Collections[i].Database = manifest.DbName
+		}
+	}
+	return
+}
+
+func replayCommand(arguments []string) {
+	flags := flag.NewFlagSet("mongodiff replay", flag.ExitOnError)
+	var contextFlags = registerContextFlags(flags)
+	var cleanOnly = flags.Bool("clean", false, "Only bring the DB back to the state before the recording, without replaying it")
+	var upsert = flags.Bool("upsert", false, "Upsert the documents by their _id instead of cleaning the DB and inserting them, so that the recording can be replayed repeatedly")
+	var strict = flags.Bool("strict", false, "Upsert like -upsert, but abort without changing anything unless every document is either in its state before the recording or already in the one after it")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mongodiff replay [options] <prefix of the generated files>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *cleanOnly && (*upsert || *strict) {
+		fmt.Println("-clean can't be combined with -upsert or -strict")
+		os.Exit(2)
+	}
+	prefix := flags.Arg(0)
+
+	manifest := readManifest(manifestFilename(prefix))
+	ctx := contextFlags.connectFor(&manifest, flags)
+	defer ctx.close()
+
+	// the DB doesn't have to be in the state before the recording when only cleaning it, and the upserts
+	// can be done again after a previous replay, so the divergences are only reported
+	if !*cleanOnly {
+		fmt.Println(blueFormat("Verifying the starting point of the recording in ") + redFormat(ctx.host))
+		ctx.verify(manifest)
+	}
+	if *upsert || *strict {
+		ctx.replayUpserts(manifest, filepath.Dir(prefix), *strict)
+		return
+	}
+	ctx.replay(manifest, filepath.Dir(prefix), *cleanOnly)
+}
+
+// connectFor connects to the DB of the manifest, or moves the changes of the manifest to the DB given via -db
+func (contextFlags *contextFlags) connectFor(manifest *replayManifest, flags *flag.FlagSet) *context {
+	dbGiven := false
+	flags.Visit(func(f *flag.Flag) {
+		dbGiven = dbGiven || f.Name == "db"
+	})
+	if dbGiven {
+		manifest.moveTo(*contextFlags.dbName)
+	} else {
+		*contextFlags.dbName = manifest.DbName
+	}
+	return contextFlags.connect()
+}
+
+// replay does what the generated scripts do: new and modified documents are removed, then
+// either the original documents are restored (clean) or the removed documents are removed and
+// the new versions of the documents are inserted (replay). Modified documents whose originals
+// haven't been kept are left as they are by cleaning and replaced only when replaying
+func (context *context) replay(manifest replayManifest, directory string, cleanOnly bool) {
+	fmt.Println(blueFormat("Cleaning mongodiff-induced changes from ") + redFormat(context.host))
+	for _, change := range manifest.Collections {
+		collection := context.collection(change.namespace())
+		removeIds(collection, parseIds(change.Added))
+		removeIds(collection, parseIds(change.restorable()))
+		if change.Metadata != nil {
+			context.changeMetadata(change, true)
+		}
+		if cleanOnly && change.RestoreFile != "" {
+			fmt.Println("\t", blueFormat("Restoring original documents in "+change.namespace()))
+			for _, document := range readDocuments(filepath.Join(directory, change.RestoreFile)) {
+				id, err := bsonutil.FindValueByKey("_id", &document)
+				if err != nil {
+					log.Fatalf("Original document in %s has no _id: %v", change.RestoreFile, document)
+				}
+				if _, err := collection.UpsertId(id, document); err != nil {
+					log.Fatalf("Could not restore document %v in %s: %v", id, change.namespace(), err)
+				}
+			}
+		}
+	}
+	if cleanOnly {
+		return
+	}
+
+	fmt.Println(blueFormat("Replaying diff"))
+	for _, change := range manifest.Collections {
+		fmt.Println("\t", blueFormat("Replaying changes done in "+change.namespace()))
+		collection := context.collection(change.namespace())
+		if change.Metadata != nil {
+			context.changeMetadata(change, false)
+		}
+		removeIds(collection, parseIds(change.Removed))
+		removeIds(collection, parseIds(change.Unrestorable))
+		if change.ImportFile == "" {
+			continue
+		}
+		for _, document := range readDocuments(filepath.Join(directory, change.ImportFile)) {
+			if err := collection.Insert(document); err != nil {
+				log.Fatalf("Could not insert document into %s: %v", change.namespace(), err)
+			}
+		}
+	}
+}
+
+// changeMetadata drops or creates the collection, drops the indexes, runs collMod and creates the indexes,
+// in this order so that an index whose definition has been changed is first dropped and then created again.
+// With clean set the changes are reverted
+func (context *context) changeMetadata(change manifestCollection, clean bool) {
+	metadata := change.Metadata
+	drop, create := metadata.Dropped, metadata.Created
+	toDrop, collMod, toCreate := metadata.RemovedIndexes, metadata.ReplayCollMod, metadata.AddedIndexes
+	if clean {
+		drop, create = metadata.Created, metadata.Dropped
+		toDrop, collMod, toCreate = metadata.AddedIndexes, metadata.CleanCollMod, metadata.RemovedIndexes
+	}
+	database := context.session.DB(change.Database)
+	if drop {
+		err := database.Run(bson.D{{Name: "drop", Value: change.Name}}, nil)
+		if queryErr, ok := err.(*mgo.QueryError); err != nil && (!ok || queryErr.Code != namespaceNotFound) {
+			log.Fatalf("Could not drop %s: %v", change.namespace(), err)
+		}
+		return
+	}
+	if create {
+		command := bson.D{{Name: "create", Value: change.Name}}
+		if metadata.Options != nil {
+			command = append(command, parseExtendedJSON(metadata.Options).(bson.D)...)
+		}
+		err := database.Run(command, nil)
+		if queryErr, ok := err.(*mgo.QueryError); err != nil && (!ok || queryErr.Code != namespaceExists) {
+			log.Fatalf("Could not create %s: %v", change.namespace(), err)
+		}
+	}
+	for _, index := range toDrop {
+		name := indexName(parseExtendedJSON(index).(bson.D))
+		err := database.Run(bson.D{{Name: "dropIndexes", Value: change.Name}, {Name: "index", Value: name}}, nil)
+		// the index is already gone when the DB has been cleaned before
+		if queryErr, ok := err.(*mgo.QueryError); err != nil && (!ok || queryErr.Code != indexNotFound) {
+			log.Fatalf("Could not drop index %s of %s: %v", name, change.namespace(), err)
+		}
+	}
+	if collMod != nil {
+		if err := database.Run(parseExtendedJSON(collMod), nil); err != nil {
+			log.Fatalf("Could not change the options of %s: %v", change.namespace(), err)
+		}
+	}
+	for _, index := range toCreate {
+		command := bson.D{{Name: "createIndexes", Value: change.Name}, {Name: "indexes", Value: []interface{}{parseExtendedJSON(index)}}}
+		if err := database.Run(command, nil); err != nil {
+			log.Fatalf("Could not create index %s of %s: %v", index, change.namespace(), err)
+		}
+	}
+}
+
+// replayUpserts applies the changes without cleaning the DB first: the removed documents are removed and
+// the new versions of the documents replace the current ones, so it can be done again and again. With strict
+// nothing is changed unless all the documents are either in the state before the recording or in the one after it
+func (context *context) replayUpserts(manifest replayManifest, directory string, strict bool) {
+	if strict {
+		if conflicts := context.conflicts(manifest, directory); len(conflicts) > 0 {
+			fmt.Println(redFormat("The DB is neither in the state before the recording nor in the one after it, nothing has been changed:"))
+			for _, conflict := range conflicts {
+				fmt.Println("\t", conflict)
+			}
+			os.Exit(1)
+		}
+	}
+	fmt.Println(blueFormat("Upserting diff into ") + redFormat(context.host))
+	for _, change := range manifest.Collections {
+		fmt.Println("\t", blueFormat("Replaying changes done in "+change.namespace()))
+		collection := context.collection(change.namespace())
+		if change.Metadata != nil {
+			context.changeMetadata(change, false)
+		}
+		removeIds(collection, parseIds(change.Removed))
+		if change.ImportFile == "" {
+			continue
+		}
+		for _, document := range readDocuments(filepath.Join(directory, change.ImportFile)) {
+			id, err := bsonutil.FindValueByKey("_id", &document)
+			if err != nil {
+				log.Fatalf("Document in %s has no _id: %v", change.ImportFile, document)
+			}
+			if _, err := collection.UpsertId(id, document); err != nil {
+				log.Fatalf("Could not upsert document %v into %s: %v", id, change.namespace(), err)
+			}
+		}
+	}
+}
+
+// documentVersions are the versions of a document before and after the recording, in the Extended JSON
+// form of the generated files; a missing document has an empty version. When the original version
+// hasn't been kept (e.g. when tailing the oplog) any existing document is taken as the one before
+type documentVersions struct {
+	before      string
+	beforeKnown bool
+	after       string
+}
+
+func (versions documentVersions) matches(current string) bool {
+	if current == versions.after {
+		return true
+	}
+	if versions.beforeKnown {
+		return current == versions.before
+	}
+	return current != ""
+}
+
+// conflicts describes the documents which are neither in their state before the recording nor in the one after it
+func (context *context) conflicts(manifest replayManifest, directory string) (conflicts []string) {
+	for _, change := range manifest.Collections {
+		imported, originals := make(map[string]string), make(map[string]string)
+		if change.ImportFile != "" {
+			imported = readDocumentLines(filepath.Join(directory, change.ImportFile))
+		}
+		if change.RestoreFile != "" {
+			originals = readDocumentLines(filepath.Join(directory, change.RestoreFile))
+		}
+		expected := make(map[string]documentVersions)
+		for _, id := range change.Added {
+			expected[string(id)] = documentVersions{beforeKnown: true, after: imported[string(id)]}
+		}
+		for _, id := range change.Modified {
+			original, ok := originals[string(id)]
+			expected[string(id)] = documentVersions{before: original, beforeKnown: ok, after: imported[string(id)]}
+		}
+		for _, id := range change.Removed {
+			original, ok := originals[string(id)]
+			expected[string(id)] = documentVersions{before: original, beforeKnown: ok}
+		}
+		ids := sortedKeys(expected)
+		current := currentVersions(context.collection(change.namespace()), ids)
+		for _, id := range ids {
+			if !expected[id].matches(current[id]) {
+				conflicts = append(conflicts, fmt.Sprintf("%s %s", change.namespace(), id))
+			}
+		}
+	}
+	return
+}
+
+// currentVersions reads the documents with the given ids (in Extended JSON) from the DB in the form used by
+// the generated files, using a query per exportBatchSize ids. The missing documents are left out
+func currentVersions(collection *mgo.Collection, ids []string) map[string]string {
+	versions := make(map[string]string)
+	for start := 0; start < len(ids); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var values []interface{}
+		for _, id := range ids[start:end] {
+			values = append(values, parseExtendedJSON(json.RawMessage(id)))
+		}
+		iter := collection.Find(bson.M{"_id": bson.M{"$in": values}}).Iter()
+		raw := bson.Raw{}
+		for iter.Next(&raw) {
+			collItem := collectionItem{}
+			document := bson.D{}
+			if err := raw.Unmarshal(&collItem); err != nil {
+				log.Fatalf("Could not read document id in %s: %v", collection.FullName, err)
+			}
+			if err := raw.Unmarshal(&document); err != nil {
+				log.Fatalf("Could not read document in %s: %v", collection.FullName, err)
+			}
+			versions[string(extendedJSON(idValue(collItem.key())))] = string(extendedJSON(document))
+		}
+		if err := iter.Close(); err != nil {
+			log.Fatalf("Could not read documents of %s: %v", collection.FullName, err)
+		}
+	}
+	return versions
+}
+
+func sortedKeys(values map[string]documentVersions) (keys []string) {
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func removeIds(collection *mgo.Collection, ids []interface{}) {
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := collection.RemoveAll(bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		log.Fatalf("Could not remove documents from %s: %v", collection.FullName, err)
+	}
+}
+
+func parseIds(ids []json.RawMessage) (parsed []interface{}) {
+	for _, id := range ids {
+		parsed = append(parsed, parseExtendedJSON(id))
+	}
+	return
+}
+
+// parseExtendedJSON converts a single value written by extendedJSON back to its BSON form
+func parseExtendedJSON(value json.RawMessage) interface{} {
+	holder := append(append([]byte(`{"v":`), value...), '}')
+	document, err := extjson.UnmarshalBsonD(holder)
+	if err != nil {
+		log.Fatalf("Could not parse %s: %v", value, err)
+	}
+	if document, err = bsonutil.GetExtendedBsonD(document); err != nil {
+		log.Fatalf("Could not convert %s: %v", value, err)
+	}
+	return document[0].Value
+}
+
+// readDocuments reads a file in the format mongoimport expects: one Extended JSON document per line
+func readDocuments(filename string) (documents []bson.D) {
+	eachDocument(filename, func(line []byte, document bson.D) {
+		documents = append(documents, document)
+	})
+	return
+}
+
+// readDocumentLines gives back the lines of the file by the ids of their documents in Extended JSON
+func readDocumentLines(filename string) map[string]string {
+	lines := make(map[string]string)
+	eachDocument(filename, func(line []byte, document bson.D) {
+		id, err := bsonutil.FindValueByKey("_id", &document)
+		if err != nil {
+			log.Fatalf("Document in %s has no _id: %v", filename, document)
+		}
+		lines[string(extendedJSON(id))] = string(line)
+	})
+	return lines
+}
+
+func eachDocument(filename string, handle func(line []byte, document bson.D)) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Could not open %s: %v", filename, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		document, err := extjson.UnmarshalBsonD(line)
+		if err != nil {
+			log.Fatalf("Could not parse document in %s: %v", filename, err)
+		}
+		if document, err = bsonutil.GetExtendedBsonD(document); err != nil {
+			log.Fatalf("Could not convert document in %s: %v", filename, err)
+		}
+		handle(line, document)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Could not read %s: %v", filename, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIdsSurviveExtendedJSON(t *testing.T) {
+	ids := []interface{}{
+		"foo",
+		bson.ObjectIdHex("501ca04b668d67b3d6489f3a"),
+		int64(1) << 40,
+		time.Date(2015, 8, 18, 7, 0, 3, 450000000, time.UTC),
+	}
+	for _, id := range ids {
+		parsed := parseExtendedJSON(extendedJSON(id))
+		if parsed, ok := parsed.(time.Time); ok {
+			if !parsed.Equal(id.(time.Time)) {
+				t.Errorf("Expected %v but got %v", id, parsed)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(parsed, id) {
+			t.Errorf("Expected %v (%T) but got %v (%T)", id, id, parsed, parsed)
+		}
+	}
+}
+
+func TestNativeReplay(t *testing.T) {
+	preFile := havingTestDataRemovalScript(t)
+	postFile := havingTestDataInjectionScript(t)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	diffData := thenCalculationOfDeltaContains(t, context,
+		func() { run("mongo", "localhost:27017/test", preFile.Name()) },
+		func() { run("mongo", "localhost:27017/test", postFile.Name()) },
+		[]interface{}{bson.ObjectIdHex("501ca04b668d67b3d6489f3a")},
+	)
+
+	context.makeScriptFiles(diffData)
+
+	thenCalculationOfDeltaContains(t, context, func() {
+		context.replay(readManifest(manifestFilename("testing")), ".", true)
+	}, func() {
+		context.replay(readManifest(manifestFilename("testing")), ".", false)
+	}, []interface{}{bson.ObjectIdHex("501ca04b668d67b3d6489f3a")})
+}
+
+func TestDocumentVersionsOfStrictReplay(t *testing.T) {
+	added := documentVersions{beforeKnown: true, after: `{"_id":1,"v":2}`}
+	removed := documentVersions{before: `{"_id":1,"v":1}`, beforeKnown: true}
+	modifiedWithoutOriginal := documentVersions{after: `{"_id":1,"v":2}`}
+	expectations := []struct {
+		versions documentVersions
+		current  string
+		matches  bool
+	}{
+		{added, "", true},
+		{added, `{"_id":1,"v":2}`, true},
+		{added, `{"_id":1,"v":3}`, false},
+		{removed, `{"_id":1,"v":1}`, true},
+		{removed, "", true},
+		{removed, `{"_id":1,"v":3}`, false},
+		{modifiedWithoutOriginal, `{"_id":1,"v":3}`, true},
+		{modifiedWithoutOriginal, "", false},
+	}
+	for _, expectation := range expectations {
+		if matches := expectation.versions.matches(expectation.current); matches != expectation.matches {
+			t.Errorf("Expected %v for %q and versions %+v", expectation.matches, expectation.current, expectation.versions)
+		}
+	}
+}
+
+func TestDocumentLinesAreReadByTheirIds(t *testing.T) {
+	file := testFile(t, "test_lines", "{\"_id\":{\"$oid\":\"501ca04b668d67b3d6489f3a\"},\"v\":1}\n\n{\"_id\":\"foo\",\"v\":{\"$numberLong\":\"2\"}}\n")
+	defer removeTestFilesIncluding(file)
+
+	lines := readDocumentLines(file.Name())
+	if lines[`{"$oid":"501ca04b668d67b3d6489f3a"}`] != `{"_id":{"$oid":"501ca04b668d67b3d6489f3a"},"v":1}` || lines[`"foo"`] != `{"_id":"foo","v":{"$numberLong":"2"}}` {
+		t.Error("Unexpected lines", lines)
+	}
+}
+
+func TestUpsertReplayCanBeRepeated(t *testing.T) {
+	preFile := havingTestDataRemovalScript(t)
+	postFile := havingTestDataInjectionScript(t)
+	changeFile := testFile(t, "test_conflict", `db.diffTest.update({"_id": ObjectId("501ca04b668d67b3d6489f3a")}, {"$set": {"a": "changed"}});`)
+	defer removeTestFilesIncluding(preFile, postFile, changeFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	context.makeScriptFiles(context.diffData(beforeData, context.collectData(false)))
+	manifest := readManifest(manifestFilename("testing"))
+
+	context.replay(manifest, ".", true)
+	if conflicts := context.conflicts(manifest, "."); len(conflicts) != 0 {
+		t.Fatal("Expected no conflicts in the state before the recording, but got", conflicts)
+	}
+	context.replayUpserts(manifest, ".", true)
+	context.replayUpserts(manifest, ".", true)
+	if conflicts := context.conflicts(manifest, "."); len(conflicts) != 0 {
+		t.Fatal("Expected no conflicts in the state after the recording, but got", conflicts)
+	}
+	if diff := context.diffData(beforeData, context.collectData(false)); !diff["test.diffTest"].Ids[bson.ObjectIdHex("501ca04b668d67b3d6489f3a")] {
+		t.Error("Expected the added document after replaying twice, but got", diff)
+	}
+
+	run("mongo", "localhost:27017/test", changeFile.Name())
+	if conflicts := context.conflicts(manifest, "."); len(conflicts) != 1 {
+		t.Error("Expected a conflict after the document has been changed, but got", conflicts)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportFormats are the formats in which the summary of the changes can be written
+var reportFormats = map[string]bool{"json": true, "html": true}
+
+// diffReport is a summary of the changes meant to be processed by other tools, e.g. asserted on in CI
+type diffReport struct {
+	Created   time.Time        `json:"created"`
+	Host      string           `json:"host"`
+	Databases []databaseReport `json:"databases"`
+	Scans     []scanTiming     `json:"scans"`
+	Files     []string         `json:"files"`
+}
+
+type databaseReport struct {
+	Name        string             `json:"name"`
+	Collections []collectionReport `json:"collections"`
+}
+
+type collectionReport struct {
+	Name     string       `json:"name"`
+	Counts   changeCounts `json:"counts"`
+	Added    []reportedID `json:"added"`
+	Modified []reportedID `json:"modified"`
+	Removed  []reportedID `json:"removed"`
+	Metadata []string     `json:"metadata,omitempty"`
+}
+
+type changeCounts struct {
+	Added    int `json:"added"`
+	Modified int `json:"modified"`
+	Removed  int `json:"removed"`
+}
+
+// reportedID is an id together with the alias of its BSON type, as used by the $type operator
+type reportedID struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scanTiming tells when a scan of the DB (or the reading of a snapshot) was done and how long it took
+type scanTiming struct {
+	Name       string    `json:"name" bson:"name"`
+	Started    time.Time `json:"started" bson:"started"`
+	DurationMs int64     `json:"durationMs" bson:"durationMs"`
+	Documents  int       `json:"documents" bson:"documents"`
+}
+
+var bsonTypeAliases = map[byte]string{
+	0x01: "double",
+	0x02: "string",
+	0x03: "object",
+	0x04: "array",
+	0x05: "binData",
+	0x07: "objectId",
+	0x08: "bool",
+	0x09: "date",
+	0x0A: "null",
+	0x0B: "regex",
+	0x0D: "javascript",
+	0x10: "int",
+	0x11: "timestamp",
+	0x12: "long",
+	0x13: "decimal",
+	0x7F: "maxKey",
+	0xFF: "minKey",
+}
+
+// uriHosts gives back only the hosts of the connection string (given via -uri or -host), the reports mustn't
+// reveal the credentials or the options (which could hold e.g. paths to the certificates)
+func uriHosts(uri string) string {
+	hosts := strings.TrimPrefix(uri, "mongodb://")
+	if end := strings.IndexAny(hosts, "/?"); end != -1 {
+		hosts = hosts[:end]
+	}
+	if at := strings.LastIndex(hosts, "@"); at != -1 {
+		hosts = hosts[at+1:]
+	}
+	return hosts
+}
+
+func reportFilename(prefix string, format string) string {
+	return prefix + "_report." + format
+}
+
+// makeReport summarizes the changes, files are the names of the files written for them
+func (context *context) makeReport(diffData data, files []string) diffReport {
+	report := diffReport{
+		Created:   time.Now(),
+		Host:      uriHosts(context.host),
+		Databases: []databaseReport{},
+		Scans:     context.scans,
+		Files:     files,
+	}
+	if context.uri != "" {
+		report.Host = uriHosts(context.uri)
+	}
+	if report.Scans == nil {
+		report.Scans = []scanTiming{}
+	}
+	if report.Files == nil {
+		report.Files = []string{}
+	}
+	databases := make(map[string]int)
+	for _, namespace := range diffData.namespaces() {
+		ids := diffData[namespace]
+		dbName, collectionName := splitNamespace(namespace)
+		index, ok := databases[dbName]
+		if !ok {
+			index = len(report.Databases)
+			databases[dbName] = index
+			report.Databases = append(report.Databases, databaseReport{Name: dbName})
+		}
+		collection := collectionReport{
+			Name:     collectionName,
+			Counts:   changeCounts{Added: len(ids.Ids), Modified: len(ids.Modified), Removed: len(ids.Removed)},
+			Added:    reportedIDs(ids.Ids),
+			Modified: reportedIDs(ids.Modified),
+			Removed:  reportedIDs(ids.Removed),
+		}
+		if ids.MetadataChanges != nil {
+			collection.Metadata = ids.MetadataChanges.descriptions()
+		}
+		report.Databases[index].Collections = append(report.Databases[index].Collections, collection)
+	}
+	return report
+}
+
+func reportedIDs(ids map[interface{}]bool) []reportedID {
+	reported := []reportedID{}
+	for id := range ids {
+		reported = append(reported, reportedID{Type: bsonTypeAliases[rawIDKey(id)[0]], Value: extendedJSON(idValue(id))})
+	}
+	sort.Slice(reported, func(i, j int) bool {
+		return string(reported[i].Value) < string(reported[j].Value)
+	})
+	return reported
+}
+
+func (report diffReport) write(format string, filename string) {
+	var out []byte
+	var err error
+	switch format {
+	case "json":
+		out, err = json.MarshalIndent(report, "", "  ")
+	default:
+		err = fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		log.Fatalln("Could not make the report", err)
+	}
+	if err := ioutil.WriteFile(filename, out, 0600); err != nil {
+		log.Fatalf("Could not save report %s: %v", filename, err)
+	}
+	fmt.Println(blueFormat("Report saved to ") + redFormat(filename))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var stdinLines chan string
+var stdinOnce sync.Once
+
+// inputLines gives back the lines typed in the terminal, stdin is read by a single goroutine
+// so that the chapters and the review can take turns in reading it
+func inputLines() <-chan string {
+	stdinOnce.Do(func() {
+		stdinLines = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				stdinLines <- scanner.Text()
+			}
+			close(stdinLines)
+		}()
+	})
+	return stdinLines
+}
+
+// reviewedChange is a single document shown in the review, its change is one of "added", "modified" and "removed"
+type reviewedChange struct {
+	change string
+	id     interface{}
+}
+
+// review lets the changes be browsed per collection before the scripts are written, every
+// document (or whole collection) can be left out of the scripts
+type review struct {
+	context    *context
+	changes    data
+	namespaces []string
+	excluded   map[string]map[interface{}]bool
+	// withoutMetadata are the collections whose changes of indexes and options have been excluded
+	withoutMetadata map[string]bool
+	lines           <-chan string
+	out             io.Writer
+}
+
+func (context *context) newReview(changes data, lines <-chan string, out io.Writer) *review {
+	review := &review{
+		context:         context,
+		changes:         changes,
+		namespaces:      changes.namespaces(),
+		excluded:        make(map[string]map[interface{}]bool),
+		withoutMetadata: make(map[string]bool),
+		lines:           lines,
+		out:             out,
+	}
+	for _, namespace := range review.namespaces {
+		review.excluded[namespace] = make(map[interface{}]bool)
+	}
+	return review
+}
+
+// reviewChanges asks which changes should end up in the scripts, nothing should be written
+// when the review has been cancelled
+func (context *context) reviewChanges(changes data) (selected data, confirmed bool) {
+	return context.newReview(changes, inputLines(), os.Stdout).run()
+}
+
+func (review *review) run() (data, bool) {
+	for {
+		review.printCollections()
+		fmt.Fprintln(review.out, blueFormat("Type ")+redFormat("<number>")+blueFormat(" to browse a collection, ")+
+			redFormat("t <number>")+blueFormat(" to include or exclude it, ")+redFormat("w")+blueFormat(" to write the scripts, ")+
+			redFormat("q")+blueFormat(" to quit without writing anything"))
+		line, ok := review.readLine()
+		if !ok {
+			return nil, false
+		}
+		command, number := parseReviewCommand(line)
+		switch {
+		case command == "q":
+			fmt.Fprintln(review.out, redFormat("Review cancelled, nothing will be written"))
+			return nil, false
+		case command == "w":
+			selected := review.selected()
+			fmt.Fprintf(review.out, "Write the scripts for %d of %d changes? [y/N] ", countChanges(selected), countChanges(review.changes))
+			answer, ok := review.readLine()
+			if !ok {
+				return nil, false
+			}
+			if strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes") {
+				return selected, true
+			}
+		case command == "t" && review.validCollection(number):
+			review.toggleCollection(review.namespaces[number-1])
+		case command == "" && review.validCollection(number):
+			if !review.browse(review.namespaces[number-1]) {
+				return nil, false
+			}
+		default:
+			fmt.Fprintln(review.out, redFormat("Unknown command: ")+line)
+		}
+	}
+}
+
+// browse shows the documents of the collection until going back to the collections, false is given back when the input ends
+func (review *review) browse(namespace string) bool {
+	changes := review.documents(namespace)
+	for {
+		fmt.Fprintln(review.out, blueFormat(namespace))
+		if metadataChanges := review.changes[namespace].MetadataChanges; metadataChanges != nil {
+			for _, description := range metadataChanges.descriptions() {
+				fmt.Fprintf(review.out, "      %s %s\n", review.mark(!review.withoutMetadata[namespace]), description)
+			}
+		}
+		for i, change := range changes {
+			fmt.Fprintf(review.out, "%4d. %s %s\n", i+1, review.mark(!review.excluded[namespace][change.id]), change)
+		}
+		fmt.Fprintln(review.out, blueFormat("Type ")+redFormat("<number>")+blueFormat(" to include or exclude a document, ")+
+			redFormat("v <number>")+blueFormat(" to view it, ")+redFormat("a")+blueFormat(" to include all, ")+
+			redFormat("n")+blueFormat(" to exclude all, ")+redFormat("b")+blueFormat(" to go back"))
+		line, ok := review.readLine()
+		if !ok {
+			return false
+		}
+		command, number := parseReviewCommand(line)
+		valid := number >= 1 && number <= len(changes)
+		switch {
+		case command == "b":
+			return true
+		case command == "a":
+			review.excluded[namespace] = make(map[interface{}]bool)
+		case command == "n":
+			for _, change := range changes {
+				review.excluded[namespace][change.id] = true
+			}
+		case command == "v" && valid:
+			review.view(namespace, changes[number-1])
+		case command == "" && valid:
+			id := changes[number-1].id
+			review.excluded[namespace][id] = !review.excluded[namespace][id]
+		default:
+			fmt.Fprintln(review.out, redFormat("Unknown command: ")+line)
+		}
+	}
+}
+
+// view prints the current version of the document, or the original one when it has been removed,
+// together with the fields changed since the original version
+func (review *review) view(namespace string, change reviewedChange) {
+	ids := review.changes[namespace]
+	original, hasOriginal := ids.Documents[change.id]
+	if change.change == "removed" {
+		if !hasOriginal {
+			fmt.Fprintln(review.out, redFormat("The original version of the document hasn't been kept"))
+			return
+		}
+		fmt.Fprintln(review.out, indentedJSON(original))
+		return
+	}
+	review.context.fetchDocuments(namespace, []interface{}{change.id}, func(document bson.Raw) {
+		fmt.Fprintln(review.out, indentedJSON(document.Data))
+		if change.change == "modified" && hasOriginal {
+			for _, field := range compareDocuments("", original, document.Data) {
+				fmt.Fprintln(review.out, "\t", field.String())
+			}
+		}
+	}, func(int) {})
+}
+
+func indentedJSON(document []byte) string {
+	raw := bson.D{}
+	if err := bson.Unmarshal(document, &raw); err != nil {
+		return fmt.Sprintf("Could not read the document: %v", err)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, extendedJSON(raw), "", "  "); err != nil {
+		return fmt.Sprintf("Could not format the document: %v", err)
+	}
+	return out.String()
+}
+
+func (review *review) printCollections() {
+	fmt.Fprintln(review.out, redFormat("Changes to review:"))
+	for i, namespace := range review.namespaces {
+		ids := review.changes[namespace]
+		total := len(ids.Ids) + len(ids.Modified) + len(ids.Removed)
+		included := total - len(review.excluded[namespace])
+		metadata := ""
+		if ids.MetadataChanges != nil {
+			metadata = ", indexes or options changed"
+		}
+		fmt.Fprintf(review.out, "%4d. %s %s (%d added, %d modified, %d removed%s; %d of %d included)\n", i+1,
+			review.mark(review.isIncluded(namespace)), blueFormat(namespace), len(ids.Ids), len(ids.Modified), len(ids.Removed), metadata, included, total)
+	}
+}
+
+func (review *review) mark(included bool) string {
+	if included {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
+func (review *review) validCollection(number int) bool {
+	return number >= 1 && number <= len(review.namespaces)
+}
+
+// isIncluded tells whether anything of the collection will be written to the scripts
+func (review *review) isIncluded(namespace string) bool {
+	if review.changes[namespace].MetadataChanges != nil && !review.withoutMetadata[namespace] {
+		return true
+	}
+	return len(review.excluded[namespace]) < len(review.documents(namespace))
+}
+
+// toggleCollection excludes the whole collection, or includes it all again when all of it has been excluded
+func (review *review) toggleCollection(namespace string) {
+	if !review.isIncluded(namespace) {
+		review.excluded[namespace] = make(map[interface{}]bool)
+		review.withoutMetadata[namespace] = false
+		return
+	}
+	for _, change := range review.documents(namespace) {
+		review.excluded[namespace][change.id] = true
+	}
+	review.withoutMetadata[namespace] = true
+}
+
+// documents lists the changed documents of the collection: the added ones first, then the modified and the removed ones
+func (review *review) documents(namespace string) (changes []reviewedChange) {
+	ids := review.changes[namespace]
+	for _, id := range sortedIds(ids.Ids) {
+		changes = append(changes, reviewedChange{"added", id})
+	}
+	for _, id := range sortedIds(ids.Modified) {
+		changes = append(changes, reviewedChange{"modified", id})
+	}
+	for _, id := range sortedIds(ids.Removed) {
+		changes = append(changes, reviewedChange{"removed", id})
+	}
+	return
+}
+
+// selected gives back only the included changes, the collections without any of them are left out
+func (review *review) selected() data {
+	selected := data{}
+	for _, namespace := range review.namespaces {
+		ids, excluded := review.changes[namespace], review.excluded[namespace]
+		kept := newCollectionIds()
+		copySelected := func(from map[interface{}]bool, to map[interface{}]bool) {
+			for id := range from {
+				if excluded[id] {
+					continue
+				}
+				to[id] = true
+				if document, ok := ids.Documents[id]; ok {
+					kept.Documents[id] = document
+				}
+				if hash, ok := ids.Hashes[id]; ok {
+					kept.Hashes[id] = hash
+				}
+			}
+		}
+		copySelected(ids.Ids, kept.Ids)
+		copySelected(ids.Modified, kept.Modified)
+		copySelected(ids.Removed, kept.Removed)
+		if !review.withoutMetadata[namespace] {
+			kept.MetadataChanges = ids.MetadataChanges
+		}
+		if len(kept.Ids)+len(kept.Modified)+len(kept.Removed) > 0 || kept.MetadataChanges != nil {
+			selected[namespace] = kept
+		}
+	}
+	return selected
+}
+
+func (review *review) readLine() (string, bool) {
+	line, ok := <-review.lines
+	return strings.TrimSpace(line), ok
+}
+
+func (change reviewedChange) String() string {
+	id := string(extendedJSON(idValue(change.id)))
+	switch change.change {
+	case "added":
+		return greenFormat("+ " + id)
+	case "modified":
+		return blueFormat("~ " + id)
+	}
+	return redFormat("- " + id)
+}
+
+// parseReviewCommand splits e.g. "v 3" into the command and the number, a bare number has no command
+func parseReviewCommand(line string) (command string, number int) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", 0
+	}
+	if number, err := strconv.Atoi(fields[0]); err == nil {
+		return "", number
+	}
+	command = strings.ToLower(fields[0])
+	if len(fields) > 1 {
+		number, _ = strconv.Atoi(fields[1])
+	}
+	return
+}
+
+func countChanges(changes data) (count int) {
+	for _, ids := range changes {
+		count += len(ids.Ids) + len(ids.Modified) + len(ids.Removed)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func reviewInput(lines ...string) <-chan string {
+	input := make(chan string, len(lines))
+	for _, line := range lines {
+		input <- line
+	}
+	close(input)
+	return input
+}
+
+func reviewedData() data {
+	changes := data{}
+	changes.collectionChanges("test.logs").Ids[1] = true
+	changes.collectionChanges("test.logs").Ids[2] = true
+	users := changes.collectionChanges("test.users")
+	users.Ids["alice"] = true
+	users.Modified["bob"] = true
+	users.Removed["carol"] = true
+	users.Documents["carol"], _ = bson.Marshal(bson.M{"_id": "carol", "name": "Carol"})
+	return changes
+}
+
+func TestReviewLeavesOutExcludedChanges(t *testing.T) {
+	var out bytes.Buffer
+	// exclude the logs, then open the users and exclude alice (the first, added document)
+	review := (&context{}).newReview(reviewedData(), reviewInput("t 1", "2", "1", "b", "w", "y"), &out)
+
+	selected, confirmed := review.run()
+	if !confirmed {
+		t.Fatal("Expected the review to be confirmed, output:", out.String())
+	}
+	if _, ok := selected["test.logs"]; ok {
+		t.Error("Expected excluded collection to be left out, but got", selected)
+	}
+	users := selected["test.users"]
+	if len(users.Ids) != 0 || !users.Modified["bob"] || !users.Removed["carol"] || users.Documents["carol"] == nil {
+		t.Error("Unexpected selected changes", users)
+	}
+	if !strings.Contains(out.String(), "Write the scripts for 2 of 5 changes?") {
+		t.Error("Expected confirmation question, but got", out.String())
+	}
+}
+
+func TestReviewCanBeCancelled(t *testing.T) {
+	for _, input := range [][]string{{"q"}, {"w", "n"}} {
+		var out bytes.Buffer
+		if _, confirmed := (&context{}).newReview(reviewedData(), reviewInput(input...), &out).run(); confirmed {
+			t.Errorf("Expected review with input %v to be cancelled", input)
+		}
+	}
+}
+
+func TestReviewShowsOriginalOfRemovedDocument(t *testing.T) {
+	var out bytes.Buffer
+	review := (&context{}).newReview(reviewedData(), reviewInput("2", "v 3", "b", "q"), &out)
+
+	review.run()
+	if !strings.Contains(out.String(), `"name": "Carol"`) {
+		t.Error("Expected removed document to be shown, but got", out.String())
+	}
+}
+
+func TestParseReviewCommand(t *testing.T) {
+	expectations := map[string]struct {
+		command string
+		number  int
+	}{
+		"3":     {"", 3},
+		" v 2 ": {"v", 2},
+		"T 1":   {"t", 1},
+		"w":     {"w", 0},
+		"":      {"", 0},
+	}
+	for line, expected := range expectations {
+		if command, number := parseReviewCommand(line); command != expected.command || number != expected.number {
+			t.Errorf("Expected %v for %q, but got %q %d", expected, line, command, number)
+		}
+	}
+}
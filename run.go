@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+)
+
+func runCommand(arguments []string) {
+	flags := flag.NewFlagSet("mongodiff run", flag.ExitOnError)
+	var contextFlags = registerContextFlags(flags)
+	var useOplog = flags.Bool("oplog", false, "Record changes by tailing the oplog instead of scanning the DB before and after (requires a replica set)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mongodiff run [options] -- <command> [arguments]")
+		fmt.Fprintln(os.Stderr, "The changes done by the command are recorded, and mongodiff exits with the exit code of the command")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(arguments)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := contextFlags.connect()
+	exitCode := 0
+	record(ctx, *useOplog, func() {
+		exitCode = runChild(flags.Args())
+	})
+	ctx.close()
+
+	if exitCode != 0 {
+		fmt.Println(resetFormat)
+		os.Exit(exitCode)
+	}
+}
+
+// runChild runs the command with the standard streams of mongodiff and gives back its exit code.
+// Ctrl+C is left to the command, so that the changes done until then are still recorded
+func runChild(commandLine []string) int {
+	fmt.Println(blueFormat("Running ") + redFormat(strings.Join(commandLine, " ")))
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	command := exec.Command(commandLine[0], commandLine[1:]...)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	err := command.Run()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		exitCode := exitError.ExitCode()
+		if exitCode < 0 {
+			exitCode = 1
+		}
+		fmt.Println(blueFormat("Command failed with exit code ") + redFormat(fmt.Sprint(exitCode)))
+		return exitCode
+	} else if err != nil {
+		log.Fatalf("Could not run %s: %v", commandLine[0], err)
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestExitCodeOfChildIsKept(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test needs sh")
+	}
+	if exitCode := runChild([]string{"sh", "-c", "exit 3"}); exitCode != 3 {
+		t.Error("Expected exit code 3, but got", exitCode)
+	}
+	if exitCode := runChild([]string{"sh", "-c", "true"}); exitCode != 0 {
+		t.Error("Expected exit code 0, but got", exitCode)
+	}
+}
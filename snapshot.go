@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const snapshotFormat = "mongodiff-snapshot"
+
+// snapshotVersion must be raised whenever the layout of the snapshot entries changes
+const snapshotVersion = 1
+
+// maxSnapshotEntryLength is well above the size of an entry holding a document of at most 16 MB together with its id
+const maxSnapshotEntryLength = 64 << 20
+
+// snapshotHeader is the first BSON document of a snapshot file. It is followed by a
+// collection entry per collection, each one followed by the entries of its documents
+type snapshotHeader struct {
+	Format       string     `bson:"format"`
+	Version      int        `bson:"version"`
+	DbName       string     `bson:"db"`
+	Databases    []string   `bson:"databases"`
+	AllDatabases bool       `bson:"allDatabases"`
+	Created      time.Time  `bson:"created"`
+	Documents    bool       `bson:"documents"`
+	IdsOnly      bool       `bson:"idsOnly"`
+	ScanTiming   scanTiming `bson:"scan"`
+}
+
+type snapshotEntry struct {
+	Collection string              `bson:"collection"`
+	Metadata   *collectionMetadata `bson:"metadata"`
+	ID         bson.Raw            `bson:"_id"`
+	Hash       []byte              `bson:"hash"`
+	Document   bson.Raw            `bson:"document"`
+}
+
+func snapshotCommand(arguments []string) {
+	flags := flag.NewFlagSet("mongodiff snapshot", flag.ExitOnError)
+	var contextFlags = registerContextFlags(flags)
+	var out = flags.String("out", "", "File to which the snapshot should be saved")
+	var withDocuments = flags.Bool("withDocuments", true, "Should the documents be saved as well, so that modified and removed documents can be restored by the clean script")
+	_ = flags.Parse(arguments)
+	if *out == "" {
+		log.Fatalln("Target file for the snapshot must be given via -out parameter")
+	}
+
+	ctx := contextFlags.connect()
+	defer ctx.close()
+
+	header := snapshotHeader{
+		DbName:       ctx.dbName,
+		Databases:    ctx.databases(),
+		AllDatabases: ctx.allDbs,
+		Documents:    *withDocuments && !ctx.idsOnly,
+		IdsOnly:      ctx.idsOnly,
+	}
+	collectedData := ctx.collectData(*withDocuments)
+	header.ScanTiming = ctx.scans[len(ctx.scans)-1]
+	writeSnapshot(*out, header, collectedData)
+	fmt.Println(blueFormat("Snapshot saved to ") + redFormat(*out))
+}
+
+func diffCommand(arguments []string) {
+	flags := flag.NewFlagSet("mongodiff diff", flag.ExitOnError)
+	var contextFlags = registerContextFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mongodiff diff [options] <before snapshot> <after snapshot>")
+		fmt.Fprintln(os.Stderr, "Documents which have been added or modified are fetched from the DB, so it should still be in the \"after\" state")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(arguments)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	store := contextFlags.idStore()
+	beforeHeader, beforeData := readSnapshot(flags.Arg(0), store)
+	afterHeader, afterData := readSnapshot(flags.Arg(1), store)
+	if beforeHeader.DbName != afterHeader.DbName {
+		log.Fatalf("Snapshots have been taken from different DBs: %s and %s", beforeHeader.DbName, afterHeader.DbName)
+	}
+	if beforeHeader.IdsOnly || afterHeader.IdsOnly {
+		fmt.Println(blueFormat("Only the ids have been scanned in a snapshot, so modified documents can't be detected"))
+	}
+	dbNames := beforeHeader.Databases
+	for _, dbName := range afterHeader.Databases {
+		if !contains(dbNames, dbName) {
+			dbNames = append(dbNames, dbName)
+		}
+	}
+	*contextFlags.dbName = strings.Join(dbNames, ",")
+	*contextFlags.allDbs = beforeHeader.AllDatabases || afterHeader.AllDatabases
+
+	ctx := contextFlags.connect()
+	defer ctx.close()
+
+	for i, header := range []snapshotHeader{beforeHeader, afterHeader} {
+		timing := header.ScanTiming
+		timing.Name = flags.Arg(i)
+		if timing.Started.IsZero() {
+			timing.Started = header.Created
+		}
+		ctx.scans = append(ctx.scans, timing)
+	}
+	changes := ctx.diffData(beforeData, afterData)
+	ctx.keepOutOfScope(changes)
+	outputChanges(ctx, changes)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSnapshot(filename string, header snapshotHeader, collectedData data) {
+	file := openFileOrFatal(filename)
+	defer func() {
+		_ = file.Close()
+	}()
+	compressor := gzip.NewWriter(file)
+	writer := bufio.NewWriter(compressor)
+
+	header.Format = snapshotFormat
+	header.Version = snapshotVersion
+	header.Created = time.Now()
+	writeSnapshotEntry(writer, header)
+	for namespace, ids := range collectedData {
+		collectionEntry := bson.D{{Name: "collection", Value: namespace}}
+		if ids.Metadata != nil {
+			collectionEntry = append(collectionEntry, bson.DocElem{Name: "metadata", Value: ids.Metadata})
+		}
+		writeSnapshotEntry(writer, collectionEntry)
+		entries := ids.stream()
+		for stored, ok := entries.next(); ok; stored, ok = entries.next() {
+			id := bson.Raw{Kind: stored.Key[0], Data: stored.Key[1:]}
+			entry := bson.D{{Name: "_id", Value: id}, {Name: "hash", Value: stored.Hash}}
+			if stored.Document != nil {
+				entry = append(entry, bson.DocElem{Name: "document", Value: bson.Raw{Kind: 0x03, Data: stored.Document}})
+			}
+			writeSnapshotEntry(writer, entry)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		log.Fatalf("Could not write snapshot %s: %v", filename, err)
+	}
+	if err := compressor.Close(); err != nil {
+		log.Fatalf("Could not write snapshot %s: %v", filename, err)
+	}
+}
+
+func writeSnapshotEntry(writer io.Writer, entry interface{}) {
+	bytes, err := bson.Marshal(entry)
+	if err != nil {
+		log.Fatalln("Could not Marshal snapshot entry", err)
+	}
+	if _, err := writer.Write(bytes); err != nil {
+		log.Fatalln("Could not write snapshot entry", err)
+	}
+}
+
+// readSnapshot reads the snapshot back, the collections with more ids than the threshold of the store are moved to disk
+func readSnapshot(filename string, store *idStore) (header snapshotHeader, collectedData data) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Could not open snapshot %s: %v", filename, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		log.Fatalf("File %s is not a mongodiff snapshot: %v", filename, err)
+	}
+	reader := bufio.NewReader(decompressor)
+
+	if ok, err := readSnapshotEntry(reader, &header); err != nil || !ok || header.Format != snapshotFormat {
+		log.Fatalf("File %s is not a mongodiff snapshot", filename)
+	}
+	if header.Version != snapshotVersion {
+		log.Fatalf("Snapshot %s has version %d, but only version %d is supported", filename, header.Version, snapshotVersion)
+	}
+
+	collectedData = make(data)
+	var current collectionIds
+	var currentNamespace string
+	finishCurrent := func() {
+		if currentNamespace != "" {
+			store.finish(&current)
+			collectedData[currentNamespace] = current
+		}
+	}
+	for {
+		entry := snapshotEntry{}
+		ok, err := readSnapshotEntry(reader, &entry)
+		if err != nil {
+			log.Fatalf("Could not read snapshot %s: %v", filename, err)
+		}
+		if !ok {
+			break
+		}
+		if entry.Collection != "" {
+			finishCurrent()
+			current = newCollectionIds()
+			current.Metadata = entry.Metadata
+			currentNamespace = entry.Collection
+			continue
+		}
+		id := idKey(entry.ID)
+		current.Ids[id] = true
+		current.Hashes[id] = string(entry.Hash)
+		if entry.Document.Data != nil {
+			current.keepDocument(id, entry.Document.Data)
+		}
+		store.spillIfNeeded(&current)
+	}
+	finishCurrent()
+	return
+}
+
+// readSnapshotEntry reads the next BSON document from the stream, it gives back false
+// when the end of the stream has been reached
+func readSnapshotEntry(reader io.Reader, entry interface{}) (bool, error) {
+	var length int32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	// the smallest BSON document consists of its length and the closing zero
+	if length < 5 || length > maxSnapshotEntryLength {
+		return false, fmt.Errorf("corrupt snapshot: entry of %d bytes", length)
+	}
+	bytes := make([]byte, length)
+	binary.LittleEndian.PutUint32(bytes, uint32(length))
+	if _, err := io.ReadFull(reader, bytes[4:]); err != nil {
+		return false, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	if err := bson.Unmarshal(bytes, entry); err != nil {
+		return false, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSnapshotSurvivesRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "test_snapshot")
+	if err != nil {
+		t.Fatal("Could not open temp file", err)
+	}
+	defer removeTestFilesIncluding(file)
+
+	document, _ := bson.Marshal(bson.M{"_id": 5, "v": "five"})
+	objectID := bson.ObjectIdHex("501ca04b668d67b3d6489f3a")
+	snapshot := data{
+		"test.diffTest": collectionIds{
+			Ids:       map[interface{}]bool{"foo": true, objectID: true, 5: true},
+			Hashes:    map[interface{}]string{"foo": "1", objectID: "2", 5: "3"},
+			Documents: map[interface{}][]byte{5: document},
+		},
+		"test.empty": newCollectionIds(),
+	}
+	empty := snapshot["test.empty"]
+	empty.Metadata = &collectionMetadata{Type: "collection", Indexes: []bson.D{{{Name: "key", Value: bson.D{{Name: "_id", Value: 1}}}, {Name: "name", Value: "_id_"}}}}
+	snapshot["test.empty"] = empty
+
+	writeSnapshot(file.Name(), snapshotHeader{DbName: "test", Databases: []string{"test"}, Documents: true}, snapshot)
+	header, restored := readSnapshot(file.Name(), nil)
+
+	if header.DbName != "test" || header.Version != snapshotVersion || !header.Documents {
+		t.Fatal("Unexpected snapshot header", header)
+	}
+	if _, ok := restored["test.empty"]; !ok || len(restored) != 2 {
+		t.Fatal("Expected both collections to be restored, but got", restored)
+	}
+	diffTest := restored["test.diffTest"]
+	for id, hash := range snapshot["test.diffTest"].Hashes {
+		if !diffTest.Ids[id] || diffTest.Hashes[id] != hash {
+			t.Errorf("Id %v (%T) has not been restored correctly: %v", id, id, diffTest)
+		}
+	}
+	if restored["test.empty"].Metadata == nil || indexName(restored["test.empty"].Metadata.Indexes[0]) != "_id_" {
+		t.Error("Metadata has not been restored correctly", restored["test.empty"].Metadata)
+	}
+	if string(diffTest.Documents[5]) != string(document) {
+		t.Error("Document has not been restored correctly", diffTest.Documents)
+	}
+	if diff := (&context{}).diffData(snapshot, restored); len(diff) != 0 {
+		t.Error("Expected no changes between the snapshot and its restored copy, but got", diff)
+	}
+}
+
+func TestCorruptSnapshotEntriesAreReported(t *testing.T) {
+	for _, length := range []int32{0, 3, -1, maxSnapshotEntryLength + 1, 100} {
+		var stream bytes.Buffer
+		_ = binary.Write(&stream, binary.LittleEndian, length)
+		stream.WriteString("\x00\x00")
+		entry := snapshotEntry{}
+		if ok, err := readSnapshotEntry(&stream, &entry); ok || err == nil || !strings.HasPrefix(err.Error(), "corrupt snapshot") {
+			t.Errorf("Expected an entry of %d bytes to be reported as corrupt, but got %v, %v", length, ok, err)
+		}
+	}
+	if ok, err := readSnapshotEntry(&bytes.Buffer{}, &snapshotEntry{}); ok || err != nil {
+		t.Errorf("Expected the end of the snapshot, but got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// idStore moves the ids of the collections which grow over the threshold out of the memory: they
+// are written to disk in runs sorted by the id, which are merged again when they are needed. Since
+// the original documents take much more space than the ids, they are moved together with the ids
+// also once they grow over byteThreshold
+type idStore struct {
+	threshold     int
+	byteThreshold int
+	directory     string
+	runs          int
+	lock          sync.Mutex
+}
+
+// storedEntry is what is kept about a document, the key is the BSON kind followed by the raw BSON value of the id
+type storedEntry struct {
+	Key      []byte `bson:"k"`
+	Hash     []byte `bson:"h"`
+	Document []byte `bson:"d,omitempty"`
+}
+
+func (entry storedEntry) id() interface{} {
+	return idKey(bson.Raw{Kind: entry.Key[0], Data: entry.Key[1:]})
+}
+
+// rawIDKey gives back the key under which the id is sorted
+func rawIDKey(id interface{}) []byte {
+	if documentKey, ok := id.(documentKey); ok {
+		return []byte(documentKey)
+	}
+	document, err := bson.Marshal(bson.D{{Name: "_id", Value: id}})
+	if err != nil {
+		log.Fatalln("Could not Marshal document id", err)
+	}
+	// the document consists of its length, the kind of the element, "_id\x00", the value and the closing zero
+	return append([]byte{document[4]}, document[9:len(document)-1]...)
+}
+
+// spillIfNeeded writes the ids kept in memory to a new run when there are more of them than the threshold
+// or when their documents are bigger than the byte threshold
+func (store *idStore) spillIfNeeded(ids *collectionIds) {
+	if store == nil {
+		return
+	}
+	tooManyIds := store.threshold > 0 && len(ids.Ids) >= store.threshold
+	tooManyBytes := store.byteThreshold > 0 && ids.documentBytes >= store.byteThreshold
+	if tooManyIds || tooManyBytes {
+		store.spill(ids)
+	}
+}
+
+// keepDocument keeps the original contents of the document in memory until the ids are spilled
+func (ids *collectionIds) keepDocument(id interface{}, document []byte) {
+	ids.Documents[id] = document
+	ids.documentBytes += len(document)
+}
+
+// finish writes the rest of the ids to a run as well once the collection has been spilled,
+// so that all of its ids are read back in the same way
+func (store *idStore) finish(ids *collectionIds) {
+	if len(ids.Runs) > 0 && len(ids.Ids) > 0 {
+		store.spill(ids)
+	}
+}
+
+func (store *idStore) spill(ids *collectionIds) {
+	filename := store.nextRun()
+	file := openFileOrFatal(filename)
+	defer func() {
+		_ = file.Close()
+	}()
+	writer := bufio.NewWriter(file)
+	for _, entry := range ids.memoryEntries() {
+		writeSnapshotEntry(writer, entry)
+	}
+	flushOrFatal(writer)
+
+	ids.Runs = append(ids.Runs, filename)
+	ids.Ids = make(map[interface{}]bool)
+	ids.Hashes = make(map[interface{}]string)
+	ids.Documents = make(map[interface{}][]byte)
+	ids.documentBytes = 0
+}
+
+func (store *idStore) nextRun() string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.directory == "" {
+		directory, err := ioutil.TempDir("", "mongodiff")
+		if err != nil {
+			log.Fatalln("Could not create directory for the ids", err)
+		}
+		store.directory = directory
+	}
+	store.runs++
+	return filepath.Join(store.directory, fmt.Sprintf("run%d", store.runs))
+}
+
+func (store *idStore) close() {
+	if store != nil && store.directory != "" {
+		_ = os.RemoveAll(store.directory)
+	}
+}
+
+// memoryEntries gives back the ids kept in memory sorted by their keys
+func (ids collectionIds) memoryEntries() []storedEntry {
+	entries := make([]storedEntry, 0, len(ids.Ids))
+	for id := range ids.Ids {
+		entries = append(entries, storedEntry{Key: rawIDKey(id), Hash: []byte(ids.Hashes[id]), Document: ids.Documents[id]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries
+}
+
+// entryStream gives back the entries one by one in the order of their keys
+type entryStream interface {
+	next() (storedEntry, bool)
+}
+
+type sliceStream []storedEntry
+
+func (stream *sliceStream) next() (storedEntry, bool) {
+	if len(*stream) == 0 {
+		return storedEntry{}, false
+	}
+	entry := (*stream)[0]
+	*stream = (*stream)[1:]
+	return entry, true
+}
+
+type runStream struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func openRun(filename string) *runStream {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Could not open ids %s: %v", filename, err)
+	}
+	return &runStream{file: file, reader: bufio.NewReader(file)}
+}
+
+func (stream *runStream) next() (entry storedEntry, ok bool) {
+	if stream.file == nil {
+		return
+	}
+	ok, err := readSnapshotEntry(stream.reader, &entry)
+	if err != nil {
+		log.Fatalf("Could not read ids %s: %v", stream.file.Name(), err)
+	}
+	if !ok {
+		_ = stream.file.Close()
+		stream.file = nil
+	}
+	return
+}
+
+// mergedStream merges the sorted streams into a single one
+type mergedStream struct {
+	streams []entryStream
+	heads   []*storedEntry
+}
+
+func (stream *mergedStream) next() (storedEntry, bool) {
+	smallest := -1
+	for i, head := range stream.heads {
+		if head == nil {
+			if entry, ok := stream.streams[i].next(); ok {
+				head = &entry
+				stream.heads[i] = head
+			} else {
+				continue
+			}
+		}
+		if smallest == -1 || bytes.Compare(head.Key, stream.heads[smallest].Key) < 0 {
+			smallest = i
+		}
+	}
+	if smallest == -1 {
+		return storedEntry{}, false
+	}
+	entry := *stream.heads[smallest]
+	stream.heads[smallest] = nil
+	return entry, true
+}
+
+// stream gives back all the ids of the collection, the ones in memory as well as the spilled ones, sorted by their keys
+func (ids collectionIds) stream() entryStream {
+	memory := sliceStream(ids.memoryEntries())
+	streams := []entryStream{&memory}
+	for _, run := range ids.Runs {
+		streams = append(streams, openRun(run))
+	}
+	return &mergedStream{streams: streams, heads: make([]*storedEntry, len(streams))}
+}
+
+// diffSorted finds the changes of a collection the same way diffData does, but by walking over
+// both sorted streams at the same time, so that the ids don't have to be in memory
+func (diff data) diffSorted(namespace string, before collectionIds, after collectionIds) {
+	beforeEntries, afterEntries := before.stream(), after.stream()
+	beforeEntry, beforeOk := beforeEntries.next()
+	afterEntry, afterOk := afterEntries.next()
+	for beforeOk || afterOk {
+		comparison := 0
+		if !beforeOk {
+			comparison = 1
+		} else if !afterOk {
+			comparison = -1
+		} else {
+			comparison = bytes.Compare(beforeEntry.Key, afterEntry.Key)
+		}
+		switch {
+		case comparison > 0:
+			diff.collectionChanges(namespace).Ids[afterEntry.id()] = true
+			afterEntry, afterOk = afterEntries.next()
+		case comparison < 0:
+			diff.keepStoredOriginal(namespace, beforeEntry)
+			diff.collectionChanges(namespace).Removed[beforeEntry.id()] = true
+			beforeEntry, beforeOk = beforeEntries.next()
+		default:
+			if hashesDiffer(string(beforeEntry.Hash), string(afterEntry.Hash)) {
+				diff.keepStoredOriginal(namespace, beforeEntry)
+				diff.collectionChanges(namespace).Modified[beforeEntry.id()] = true
+			}
+			beforeEntry, beforeOk = beforeEntries.next()
+			afterEntry, afterOk = afterEntries.next()
+		}
+	}
+}
+
+func (diff data) keepStoredOriginal(namespace string, entry storedEntry) {
+	if entry.Document != nil {
+		diff.collectionChanges(namespace).Documents[entry.id()] = entry.Document
+	}
+}
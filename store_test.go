@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func havingIds(store *idStore, hashes map[interface{}]string) collectionIds {
+	ids := newCollectionIds()
+	for id, hash := range hashes {
+		ids.Ids[id] = true
+		ids.Hashes[id] = hash
+		ids.Documents[id], _ = bson.Marshal(bson.M{"hash": hash})
+		store.spillIfNeeded(&ids)
+	}
+	store.finish(&ids)
+	return ids
+}
+
+func TestDiffOfSpilledIds(t *testing.T) {
+	objectID := bson.ObjectIdHex("501ca04b668d67b3d6489f3a")
+	before := map[interface{}]string{"kept": "1", "modified": "2", "removed": "3", 5: "4", objectID: "5"}
+	after := map[interface{}]string{"kept": "1", "modified": "changed", "added": "6", 5: "4", objectID: "5", 6.5: "7"}
+
+	store := &idStore{threshold: 2}
+	defer store.close()
+	spilledBefore, spilledAfter := havingIds(store, before), havingIds(store, after)
+	if len(spilledBefore.Runs) == 0 || len(spilledBefore.Ids) != 0 {
+		t.Fatal("Expected the ids to be moved to disk, but got", spilledBefore)
+	}
+
+	expected := (&context{}).diffData(data{"test.diffTest": havingIds(nil, before)}, data{"test.diffTest": havingIds(nil, after)})
+	diff := (&context{}).diffData(data{"test.diffTest": spilledBefore}, data{"test.diffTest": spilledAfter})
+	if !reflect.DeepEqual(diff["test.diffTest"].Ids, expected["test.diffTest"].Ids) ||
+		!reflect.DeepEqual(diff["test.diffTest"].Modified, expected["test.diffTest"].Modified) ||
+		!reflect.DeepEqual(diff["test.diffTest"].Removed, expected["test.diffTest"].Removed) ||
+		!reflect.DeepEqual(diff["test.diffTest"].Documents, expected["test.diffTest"].Documents) {
+		t.Errorf("Expected the same changes as in memory: %v, but got %v", expected, diff)
+	}
+}
+
+func TestNewSpilledCollectionIsAdded(t *testing.T) {
+	store := &idStore{threshold: 1}
+	defer store.close()
+	after := havingIds(store, map[interface{}]string{"foo": "1", "bar": "2"})
+
+	diff := (&context{}).diffData(data{}, data{"test.diffTest": after})
+	if len(diff["test.diffTest"].Ids) != 2 || !diff["test.diffTest"].Ids["foo"] || !diff["test.diffTest"].Ids["bar"] {
+		t.Error("Expected both documents to be added, but got", diff)
+	}
+}
+
+func TestSpilledSnapshotSurvivesRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "test_snapshot")
+	if err != nil {
+		t.Fatal("Could not open temp file", err)
+	}
+	defer removeTestFilesIncluding(file)
+	store := &idStore{threshold: 2}
+	defer store.close()
+
+	hashes := map[interface{}]string{"foo": "1", "bar": "2", "baz": "3", 5: "4"}
+	writeSnapshot(file.Name(), snapshotHeader{DbName: "test"}, data{"test.diffTest": havingIds(store, hashes)})
+	_, restored := readSnapshot(file.Name(), store)
+
+	if len(restored["test.diffTest"].Runs) == 0 {
+		t.Fatal("Expected the restored ids to be moved to disk, but got", restored)
+	}
+	if diff := (&context{}).diffData(data{"test.diffTest": havingIds(nil, hashes)}, restored); len(diff) != 0 {
+		t.Error("Expected no changes between the snapshot and its restored copy, but got", diff)
+	}
+}
+
+func TestBigDocumentsAreSpilled(t *testing.T) {
+	store := &idStore{threshold: 1000, byteThreshold: 100}
+	defer store.close()
+	ctx := &context{store: store}
+	ids := newCollectionIds()
+	for _, id := range []string{"foo", "bar", "baz"} {
+		document, err := bson.Marshal(bson.M{"_id": id, "v": strings.Repeat("x", 60)})
+		if err != nil {
+			t.Fatal("Could not Marshal test document", err)
+		}
+		ctx.addDocument(&ids, bson.Raw{Kind: 0x03, Data: document}, true)
+	}
+	if len(ids.Runs) != 1 || len(ids.Ids) != 1 || len(ids.Documents) != 1 {
+		t.Fatal("Expected the first two documents to be moved to disk together with their ids, but got", ids)
+	}
+	store.finish(&ids)
+
+	modified := data{"test.diffTest": havingIds(nil, map[interface{}]string{"foo": "changed"})}
+	diff := (&context{}).diffData(data{"test.diffTest": ids}, modified)
+	if len(diff["test.diffTest"].Documents) != 3 {
+		t.Error("Expected the originals to be read back from disk, but got", diff["test.diffTest"].Documents)
+	}
+}
+
+func TestIdsOnlyScanIsSpilled(t *testing.T) {
+	store := &idStore{threshold: 2}
+	defer store.close()
+	ctx := &context{idsOnly: true, store: store}
+	ids := newCollectionIds()
+	hashes := map[interface{}]string{"foo": "1", "bar": "2", "baz": "3", 5: "4"}
+	for id := range hashes {
+		document, err := bson.Marshal(bson.M{"_id": id, "v": 1})
+		if err != nil {
+			t.Fatal("Could not Marshal test document", err)
+		}
+		ctx.addDocument(&ids, bson.Raw{Kind: 0x03, Data: document}, false)
+	}
+	store.finish(&ids)
+
+	if len(ids.Runs) == 0 || len(ids.Ids) != 0 || len(ids.Hashes) != 0 {
+		t.Fatal("Expected only the ids to be moved to disk, but got", ids)
+	}
+	if diff := (&context{}).diffData(data{"test.diffTest": havingIds(nil, hashes)}, data{"test.diffTest": ids}); len(diff) != 0 {
+		t.Error("Expected no changes between the scanned ids and the same ids in memory, but got", diff)
+	}
+}
@@ -5,22 +5,36 @@ import (
 	"bytes"
 	"log"
 	"os"
-	"text/template"
 	"runtime"
+	"text/template"
 )
 
 type templateData struct {
+	DbName    string
+	Filename  string
+	Username  string
+	Password  string
+	Databases []databaseChanges
+}
+
+type databaseChanges struct {
 	DbName            string
-	Filename          string
-	Username          string
-	Password          string
 	CollectionChanges []collectionChange
 }
 
 type collectionChange struct {
-	CollectionName   string
-	ImportScriptName string
-	AddedIds         []string
+	CollectionName    string
+	ImportScriptName  string
+	RestoreScriptName string
+	AddedIds          []string
+	ModifiedIds       []string
+	// ReplacedIds are the modified documents whose originals haven't been kept, they are removed
+	// by the replay script instead of the clean one
+	ReplacedIds []string
+	RemovedIds  []string
+	// Replay and Clean change the indexes and options of the collection
+	Replay metadataSteps
+	Clean  metadataSteps
 }
 
 type templateConfiguration struct {
@@ -31,13 +45,30 @@ type templateConfiguration struct {
 
 var templateConfigurations = []templateConfiguration{
 	{"{{.Filename}}_clean.js", "data/template_js", 0600},
+	{"{{.Filename}}_replay.js", "data/template_replay_js", 0600},
 	{"{{.Filename}}.bat", "data/template_replay_bat", 0600},
 	{"{{.Filename}}.sh", "data/template_replay_bash", 0700},
 	{"{{.Filename}}_clean.bat", "data/template_clean_bat", 0600},
 	{"{{.Filename}}_clean.sh", "data/template_clean_bash", 0700},
 }
 
-func (templateData *templateData) WriteTemplates() {
+// add puts the change among the changes of its DB, databases remembers the position of every DB
+func (templateData *templateData) add(dbName string, change collectionChange, databases map[string]int) {
+	index, ok := databases[dbName]
+	if !ok {
+		index = len(templateData.Databases)
+		databases[dbName] = index
+		templateData.Databases = append(templateData.Databases, databaseChanges{DbName: dbName})
+	}
+	templateData.Databases[index].CollectionChanges = append(templateData.Databases[index].CollectionChanges, change)
+}
+
+func (templateData *templateData) WriteTemplates() []string {
+	return writeTemplates(templateConfigurations, templateData)
+}
+
+// writeTemplates expands the templates of the configurations with the data into the files named by them
+func writeTemplates(configurations []templateConfiguration, data interface{}) (filenames []string) {
 	var toRemove []*os.File
 	var toFlush []*bufio.Writer
 	defer func() {
@@ -48,8 +79,10 @@ func (templateData *templateData) WriteTemplates() {
 			_ = f.Close()
 		}
 	}()
-	for _, configuration := range templateConfigurations {
-		file := openFileOrFatal(templateData.getFilename(configuration))
+	for _, configuration := range configurations {
+		filename := getFilename(configuration, data)
+		filenames = append(filenames, filename)
+		file := openFileOrFatal(filename)
 		if runtime.GOOS != "windows" {
 			if err := file.Chmod(configuration.mode); err != nil {
 				log.Printf("Could not change file privileges for file %s, err:%v", file.Name(), err)
@@ -62,19 +95,20 @@ func (templateData *templateData) WriteTemplates() {
 		if err != nil {
 			log.Fatalf("Template couldn't be parsed %s, err:%v", configuration.filenamePattern, err)
 		}
-		if err := template.Execute(fileWriter, templateData); err != nil {
+		if err := template.Execute(fileWriter, data); err != nil {
 			log.Fatalf("Template couldn't be expanded %s, err:%v", configuration.filenamePattern, err)
 		}
 	}
+	return
 }
 
-func (templateData *templateData) getFilename(configuration templateConfiguration) string {
+func getFilename(configuration templateConfiguration, data interface{}) string {
 	template, err := template.New(configuration.filenamePattern).Parse(configuration.filenamePattern)
 	if err != nil {
 		log.Fatalf("Template couldn't be parsed %s, err:%v", configuration.filenamePattern, err)
 	}
 	var filenameBuffer = &bytes.Buffer{}
-	if err := template.Execute(filenameBuffer, templateData); err != nil {
+	if err := template.Execute(filenameBuffer, data); err != nil {
 		log.Fatalf("Template couldn't be expanded %s, err:%v", configuration.filenamePattern, err)
 	}
 	return string(filenameBuffer.Bytes())
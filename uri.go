@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// mgoOptions are the connection string options understood by mgo.ParseURL itself
+var mgoOptions = map[string]bool{
+	"authSource":        true,
+	"authMechanism":     true,
+	"gssapiServiceName": true,
+	"replicaSet":        true,
+	"maxPoolSize":       true,
+	"connect":           true,
+}
+
+// tlsOptions holds the TLS related connection string options, which mgo doesn't know about
+type tlsOptions struct {
+	enabled               bool
+	caFile                string
+	certificateKeyFile    string
+	allowInvalidCerts     bool
+	allowInvalidHostnames bool
+}
+
+// parseConnectionURI understands the standard MongoDB connection string, including the TLS options
+// (tls/ssl, tlsCAFile, tlsCertificateKeyFile, tlsInsecure, tlsAllowInvalidCertificates and
+// tlsAllowInvalidHostnames) which are handled here instead of in mgo
+func parseConnectionURI(uri string) (*mgo.DialInfo, error) {
+	if !strings.HasPrefix(uri, "mongodb://") {
+		return nil, fmt.Errorf("connection string must start with mongodb://")
+	}
+	base, query := uri, ""
+	if c := strings.Index(uri, "?"); c != -1 {
+		base, query = uri[:c], uri[c+1:]
+	}
+
+	tlsOptions := tlsOptions{}
+	var passedOptions []string
+	for _, pair := range strings.FieldsFunc(query, func(c rune) bool { return c == '&' || c == ';' }) {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("connection option must be key=value: %s", pair)
+		}
+		// the values are percent-encoded, e.g. paths with spaces; a plus sign is kept since file names may contain it
+		key, value := keyValue[0], keyValue[1]
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("connection option %s is not properly encoded: %v", key, err)
+		}
+		switch key {
+		case "tls", "ssl":
+			tlsOptions.enabled = value == "true"
+		case "tlsCAFile", "sslCAFile":
+			tlsOptions.enabled = true
+			tlsOptions.caFile = value
+		case "tlsCertificateKeyFile", "sslPEMKeyFile":
+			tlsOptions.enabled = true
+			tlsOptions.certificateKeyFile = value
+		case "tlsInsecure":
+			tlsOptions.allowInvalidCerts = value == "true"
+			tlsOptions.allowInvalidHostnames = value == "true"
+		case "tlsAllowInvalidCertificates", "sslAllowInvalidCertificates":
+			tlsOptions.allowInvalidCerts = value == "true"
+		case "tlsAllowInvalidHostnames", "sslAllowInvalidHostnames":
+			tlsOptions.allowInvalidHostnames = value == "true"
+		default:
+			if mgoOptions[key] {
+				passedOptions = append(passedOptions, pair)
+			} else {
+				fmt.Printf("Ignoring unsupported connection option %s\n", key)
+			}
+		}
+	}
+	if len(passedOptions) > 0 {
+		base = base + "?" + strings.Join(passedOptions, "&")
+	}
+
+	info, err := mgo.ParseURL(base)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mechanism == "SCRAM-SHA-256" {
+		return nil, fmt.Errorf("authentication mechanism SCRAM-SHA-256 is not supported by the driver, please use SCRAM-SHA-1 or MONGODB-X509")
+	}
+	if tlsOptions.enabled {
+		config, err := tlsOptions.config()
+		if err != nil {
+			return nil, err
+		}
+		if info.Mechanism == "MONGODB-X509" && info.Username == "" {
+			if info.Username, err = certificateSubject(config); err != nil {
+				return nil, err
+			}
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr.String(), config)
+		}
+	} else if info.Mechanism == "MONGODB-X509" {
+		return nil, fmt.Errorf("authentication mechanism MONGODB-X509 needs a client certificate given via tlsCertificateKeyFile")
+	}
+	return info, nil
+}
+
+func (options tlsOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: options.allowInvalidCerts,
+	}
+	if options.caFile != "" {
+		pem, err := ioutil.ReadFile(options.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file %s: %v", options.caFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.caFile)
+		}
+	}
+	if options.certificateKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.certificateKeyFile, options.certificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client certificate %s: %v", options.certificateKeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if options.allowInvalidHostnames && !options.allowInvalidCerts {
+		// hostname verification can't be switched off on its own, so the chain is verified here instead
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, config.RootCAs)
+		}
+	}
+	return config, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, rawCert := range rawCerts {
+		certificate, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = certificate
+		} else {
+			intermediates.AddCert(certificate)
+		}
+	}
+	if leaf == nil {
+		return fmt.Errorf("server didn't present a certificate")
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// certificateSubject is the user name under which the client certificate authenticates with MONGODB-X509
+func certificateSubject(config *tls.Config) (string, error) {
+	if len(config.Certificates) == 0 {
+		return "", fmt.Errorf("authentication mechanism MONGODB-X509 needs a client certificate given via tlsCertificateKeyFile")
+	}
+	certificate, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return certificate.Subject.String(), nil
+}
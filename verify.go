@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// startingPoint is a compact fingerprint of a collection before the recording, kept in the manifest so
+// that a DB can be checked before the recording is replayed into it: whether the collection existed,
+// how many documents (matching its query) it had and the hashes of the original versions of the modified
+// and removed documents. A document whose original version hasn't been kept has an empty hash, it only has
+// to exist. The added documents of the manifest mustn't exist yet
+type startingPoint struct {
+	Exists bool              `json:"exists"`
+	Count  *int              `json:"count,omitempty"`
+	Query  json.RawMessage   `json:"query,omitempty"`
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+// observedCollection is what has been found in the DB for a starting point: the current
+// versions of the documents are given by their ids and are empty for the missing ones
+type observedCollection struct {
+	exists   bool
+	count    int
+	versions map[string]string
+}
+
+// documentMismatch is a document which isn't in its state after the recording: it is either missing,
+// extra (i.e. it should have been removed) or differs from the expected version in the listed fields
+type documentMismatch struct {
+	id     string
+	kind   string
+	fields []fieldChange
+}
+
+const (
+	documentMissing = "missing"
+	documentExtra   = "extra"
+	documentDiffers = "differs"
+)
+
+// maxListedIds limits how many ids are listed in a single divergence
+const maxListedIds = 5
+
+func verifyCommand(arguments []string) {
+	flags := flag.NewFlagSet("mongodiff verify", flag.ExitOnError)
+	var contextFlags = registerContextFlags(flags)
+	var after = flags.Bool("after", false, "Check that the DB is in the state after the recording, e.g. once the setup script has been run, instead of the one before it")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mongodiff verify [options] <prefix of the generated files>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	prefix := flags.Arg(0)
+	manifest := readManifest(manifestFilename(prefix))
+	ctx := contextFlags.connectFor(&manifest, flags)
+	defer ctx.close()
+
+	var matches bool
+	if *after {
+		matches = ctx.verifyAfter(manifest, filepath.Dir(prefix))
+	} else {
+		matches = ctx.verify(manifest)
+	}
+	if !matches {
+		os.Exit(1)
+	}
+}
+
+// startingPointsOf fingerprints the collections as they were before the changes, it has to be done
+// while the DB is still in the state after the recording
+func (context *context) startingPointsOf(changes data) map[string]*startingPoint {
+	points := make(map[string]*startingPoint)
+	for namespace, ids := range changes {
+		points[namespace] = context.startingPoint(namespace, ids)
+	}
+	return points
+}
+
+func (context *context) startingPoint(namespace string, ids collectionIds) *startingPoint {
+	point := &startingPoint{Exists: true, Hashes: make(map[string]string)}
+	if metadataChanges := ids.MetadataChanges; metadataChanges != nil {
+		if metadataChanges.Created {
+			return &startingPoint{}
+		}
+		// views have no documents of their own
+		if metadataChanges.kind() == "view" {
+			return point
+		}
+	}
+	query := context.queries.queryFor(namespace)
+	if query != nil {
+		point.Query = extendedJSON(query)
+	}
+	count := context.countBefore(namespace, ids, query)
+	point.Count = &count
+	for _, changed := range []map[interface{}]bool{ids.Modified, ids.Removed} {
+		for id := range changed {
+			hash := ""
+			if document, ok := ids.Documents[id]; ok {
+				hash = documentHash(document)
+			}
+			point.Hashes[string(extendedJSON(idValue(id)))] = hash
+		}
+	}
+	return point
+}
+
+// countBefore gives back how many documents the collection had before the recording by reverting the changes in the
+// current count. The modified documents which don't match the query anymore have matched it before the recording
+func (context *context) countBefore(namespace string, ids collectionIds, query interface{}) int {
+	count, err := context.collection(namespace).Find(query).Count()
+	if err != nil {
+		log.Fatalf("Could not count documents of %s: %v", namespace, err)
+	}
+	outOfScope := 0
+	if query != nil {
+		outOfScope = len(ids.Modified) - len(context.matchingIds(namespace, ids.Modified, query))
+	}
+	return count - len(ids.Ids) + len(ids.Removed) + outOfScope
+}
+
+// documentHash is the hash of the document in the form used by the generated files
+func documentHash(document []byte) string {
+	raw := bson.D{}
+	if err := bson.Unmarshal(document, &raw); err != nil {
+		log.Fatalln("Could not Unmarshal original document", err)
+	}
+	return versionHash(string(extendedJSON(raw)))
+}
+
+func versionHash(version string) string {
+	sum := md5.Sum([]byte(version))
+	return hex.EncodeToString(sum[:])
+}
+
+// verify tells whether the DB matches the state before the recording, the collections which don't are listed
+func (context *context) verify(manifest replayManifest) bool {
+	var unknown []string
+	diverging := 0
+	for _, change := range manifest.Collections {
+		if change.Before == nil {
+			unknown = append(unknown, change.namespace())
+			continue
+		}
+		divergences := change.Before.divergences(change.Added, context.observe(change))
+		if len(divergences) == 0 {
+			continue
+		}
+		diverging++
+		fmt.Println("\t", redFormat(change.namespace()))
+		for _, divergence := range divergences {
+			fmt.Println("\t\t", divergence)
+		}
+	}
+	if len(unknown) > 0 {
+		fmt.Println(blueFormat("No starting point has been recorded for ") + strings.Join(unknown, ", "))
+	}
+	if diverging > 0 {
+		fmt.Printf(redFormat("The DB doesn't match the state before the recording in %d of %d collections\n"), diverging, len(manifest.Collections))
+		return false
+	}
+	fmt.Println(blueFormat("The DB matches the state before the recording"))
+	return true
+}
+
+// observe reads from the DB what is needed to compare the collection with its starting point
+func (context *context) observe(change manifestCollection) (observed observedCollection) {
+	point := change.Before
+	observed.exists = context.exists(change)
+	if !observed.exists || !point.Exists {
+		return
+	}
+	collection := context.collection(change.namespace())
+	if point.Count != nil {
+		var query interface{}
+		if point.Query != nil {
+			query = parseExtendedJSON(point.Query)
+		}
+		count, err := collection.Find(query).Count()
+		if err != nil {
+			log.Fatalf("Could not count documents of %s: %v", change.namespace(), err)
+		}
+		observed.count = count
+	}
+	ids := sortedStringKeys(point.Hashes)
+	for _, id := range change.Added {
+		ids = append(ids, string(id))
+	}
+	observed.versions = currentVersions(collection, ids)
+	return
+}
+
+func (context *context) exists(change manifestCollection) (exists bool) {
+	for _, info := range listCollections(context.session, change.Database) {
+		exists = exists || info.Name == change.Name
+	}
+	return
+}
+
+// divergences describes how the observed collection differs from the starting point, in which the
+// added documents don't exist yet, nothing when it matches
+func (point *startingPoint) divergences(added []json.RawMessage, observed observedCollection) (divergences []string) {
+	if !point.Exists {
+		if observed.exists {
+			divergences = append(divergences, "exists, although it has been created during the recording")
+		}
+		return
+	}
+	if !observed.exists {
+		return append(divergences, "doesn't exist")
+	}
+	if point.Count != nil && observed.count != *point.Count {
+		divergences = append(divergences, fmt.Sprintf("has %d documents instead of %d", observed.count, *point.Count))
+	}
+	var existing, missing, different []string
+	for _, id := range added {
+		if observed.versions[string(id)] != "" {
+			existing = append(existing, string(id))
+		}
+	}
+	for _, id := range sortedStringKeys(point.Hashes) {
+		current := observed.versions[id]
+		switch {
+		case current == "":
+			missing = append(missing, id)
+		case point.Hashes[id] != "" && versionHash(current) != point.Hashes[id]:
+			different = append(different, id)
+		}
+	}
+	if len(existing) > 0 {
+		divergences = append(divergences, "added documents already exist: "+listIds(existing))
+	}
+	if len(missing) > 0 {
+		divergences = append(divergences, "modified or removed documents are missing: "+listIds(missing))
+	}
+	if len(different) > 0 {
+		divergences = append(divergences, "documents differ from their versions before the recording: "+listIds(different))
+	}
+	return
+}
+
+// listIds joins the ids, only the first few of them are listed when there are many
+func listIds(ids []string) string {
+	if len(ids) <= maxListedIds {
+		return strings.Join(ids, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(ids[:maxListedIds], ", "), len(ids)-maxListedIds)
+}
+
+// verifyAfter tells whether the DB matches the state after the recording, which the generated files describe:
+// the added and modified documents have to be there in the version of the import files while the removed ones
+// have to be gone. The documents which don't match are listed together with their differing fields
+func (context *context) verifyAfter(manifest replayManifest, directory string) bool {
+	diverging := 0
+	for _, change := range manifest.Collections {
+		var problems []string
+		exists := context.exists(change)
+		if change.Metadata != nil && change.Metadata.Created && !exists {
+			problems = append(problems, "doesn't exist, although it has been created during the recording")
+		}
+		if change.Metadata != nil && change.Metadata.Dropped && exists {
+			problems = append(problems, "exists, although it has been dropped during the recording")
+		}
+		expected := make(map[string]string)
+		imported := make(map[string]string)
+		if change.ImportFile != "" {
+			imported = readDocumentLines(filepath.Join(directory, change.ImportFile))
+		}
+		// an added or modified document which hasn't been exported had been removed again before the end of the recording
+		for _, id := range append(append([]json.RawMessage(nil), change.Added...), change.Modified...) {
+			expected[string(id)] = imported[string(id)]
+		}
+		for _, id := range change.Removed {
+			expected[string(id)] = ""
+		}
+		current := currentVersions(context.collection(change.namespace()), sortedStringKeys(expected))
+		for _, mismatch := range compareAfterState(expected, current) {
+			problems = append(problems, mismatch.kind+": "+mismatch.id)
+			for _, field := range mismatch.fields {
+				problems = append(problems, "\t"+field.String())
+			}
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		diverging++
+		fmt.Println("\t", redFormat(change.namespace()))
+		for _, problem := range problems {
+			fmt.Println("\t\t", problem)
+		}
+	}
+	if diverging > 0 {
+		fmt.Printf(redFormat("The DB doesn't match the state after the recording in %d of %d collections\n"), diverging, len(manifest.Collections))
+		return false
+	}
+	fmt.Println(blueFormat("The DB matches the state after the recording"))
+	return true
+}
+
+// compareAfterState compares the current versions of the documents with the expected ones, both are given by
+// the ids of the documents in the form used by the generated files and are empty for the documents which
+// (should) not exist. The fields of a differing document are changed from the expected to the current version
+func compareAfterState(expected map[string]string, current map[string]string) (mismatches []documentMismatch) {
+	for _, id := range sortedStringKeys(expected) {
+		expectedVersion, currentVersion := expected[id], current[id]
+		switch {
+		case expectedVersion == currentVersion:
+		case currentVersion == "":
+			mismatches = append(mismatches, documentMismatch{id: id, kind: documentMissing})
+		case expectedVersion == "":
+			mismatches = append(mismatches, documentMismatch{id: id, kind: documentExtra})
+		default:
+			fields := compareDocuments("", extendedJSONToBSON(expectedVersion), extendedJSONToBSON(currentVersion))
+			mismatches = append(mismatches, documentMismatch{id: id, kind: documentDiffers, fields: fields})
+		}
+	}
+	return
+}
+
+func sortedStringKeys(values map[string]string) (keys []string) {
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// extendedJSONToBSON converts a document in the form used by the generated files back to raw BSON
+func extendedJSONToBSON(document string) []byte {
+	raw, err := bson.Marshal(parseExtendedJSON(json.RawMessage(document)))
+	if err != nil {
+		log.Fatalf("Could not Marshal %s: %v", document, err)
+	}
+	return raw
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStartingPointDivergences(t *testing.T) {
+	count := 3
+	original := `{"_id":"modified","v":1}`
+	point := &startingPoint{
+		Exists: true,
+		Count:  &count,
+		Hashes: map[string]string{`"modified"`: versionHash(original), `"removed"`: ""},
+	}
+	added := []json.RawMessage{json.RawMessage(`"added"`)}
+	matching := observedCollection{exists: true, count: 3, versions: map[string]string{`"modified"`: original, `"removed"`: `{"_id":"removed"}`}}
+	if divergences := point.divergences(added, matching); len(divergences) != 0 {
+		t.Error("Expected no divergences, but got", divergences)
+	}
+
+	diverging := observedCollection{exists: true, count: 4, versions: map[string]string{`"added"`: `{"_id":"added"}`, `"modified"`: `{"_id":"modified","v":2}`}}
+	expected := []string{
+		"has 4 documents instead of 3",
+		`added documents already exist: "added"`,
+		`modified or removed documents are missing: "removed"`,
+		`documents differ from their versions before the recording: "modified"`,
+	}
+	if divergences := point.divergences(added, diverging); !reflect.DeepEqual(divergences, expected) {
+		t.Errorf("Expected %v, but got %v", expected, divergences)
+	}
+	if divergences := point.divergences(added, observedCollection{}); !reflect.DeepEqual(divergences, []string{"doesn't exist"}) {
+		t.Error("Expected a missing collection, but got", divergences)
+	}
+}
+
+func TestStartingPointOfCreatedCollection(t *testing.T) {
+	ids := newCollectionIds()
+	ids.Ids["added"] = true
+	ids.MetadataChanges = createdCollection(&collectionMetadata{Type: "collection"})
+	point := (&context{}).startingPoint("test.users", ids)
+	if point.Exists || point.Count != nil || len(point.Hashes) != 0 {
+		t.Error("Expected a created collection not to exist before the recording, but got", point)
+	}
+	if divergences := point.divergences(nil, observedCollection{exists: true}); len(divergences) != 1 {
+		t.Error("Expected an existing collection to diverge, but got", divergences)
+	}
+	if divergences := point.divergences(nil, observedCollection{}); len(divergences) != 0 {
+		t.Error("Expected no divergences, but got", divergences)
+	}
+}
+
+func TestManyIdsAreShortened(t *testing.T) {
+	ids := []string{"1", "2", "3", "4", "5", "6", "7"}
+	if listed := listIds(ids); listed != "1, 2, 3, 4, 5 and 2 more" {
+		t.Error("Unexpected list", listed)
+	}
+}
+
+func TestStartingPointIsVerified(t *testing.T) {
+	preFile := havingTestDataRemovalScript(t)
+	postFile := havingTestDataInjectionScript(t)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	context.makeScriptFiles(context.diffData(beforeData, context.collectData(false)))
+	manifest := readManifest(manifestFilename("testing"))
+
+	if context.verify(manifest) {
+		t.Error("Expected the DB in the state after the recording not to match the starting point")
+	}
+	context.replay(manifest, ".", true)
+	if !context.verify(manifest) {
+		t.Error("Expected the cleaned DB to match the starting point")
+	}
+}
+
+func TestAfterStateMismatches(t *testing.T) {
+	expected := map[string]string{
+		`"added"`:    `{"_id":"added","v":1}`,
+		`"modified"`: `{"_id":"modified","v":2,"tags":["a","b"]}`,
+		`"removed"`:  "",
+		`"same"`:     `{"_id":"same"}`,
+	}
+	current := map[string]string{
+		`"modified"`: `{"_id":"modified","v":1,"tags":["a","c"]}`,
+		`"removed"`:  `{"_id":"removed"}`,
+		`"same"`:     `{"_id":"same"}`,
+	}
+	mismatches := compareAfterState(expected, current)
+	if len(mismatches) != 3 {
+		t.Fatal("Expected 3 mismatches, but got", mismatches)
+	}
+	if mismatches[0].id != `"added"` || mismatches[0].kind != documentMissing {
+		t.Error("Expected the added document to be missing, but got", mismatches[0])
+	}
+	if mismatches[2].id != `"removed"` || mismatches[2].kind != documentExtra {
+		t.Error("Expected the removed document to be extra, but got", mismatches[2])
+	}
+	var fields []string
+	for _, field := range mismatches[1].fields {
+		fields = append(fields, field.String())
+	}
+	if expectedFields := []string{"~ v: 2 -> 1", `~ tags.1: "b" -> "c"`}; mismatches[1].kind != documentDiffers || !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("Expected the modified document to differ in %v, but got %v", expectedFields, mismatches[1])
+	}
+}
+
+func TestAfterStateIsVerified(t *testing.T) {
+	preFile := havingTestDataRemovalScript(t)
+	postFile := havingTestDataInjectionScript(t)
+	defer removeTestFilesIncluding(preFile, postFile)
+
+	context := havingContextInstance(t)
+	defer context.close()
+
+	run("mongo", "localhost:27017/test", preFile.Name())
+	beforeData := context.collectData(true)
+	run("mongo", "localhost:27017/test", postFile.Name())
+	context.makeScriptFiles(context.diffData(beforeData, context.collectData(false)))
+	manifest := readManifest(manifestFilename("testing"))
+
+	if !context.verifyAfter(manifest, ".") {
+		t.Error("Expected the DB to match the state after the recording")
+	}
+	context.replay(manifest, ".", true)
+	if context.verifyAfter(manifest, ".") {
+		t.Error("Expected the cleaned DB not to match the state after the recording")
+	}
+	context.replay(manifest, ".", false)
+	if !context.verifyAfter(manifest, ".") {
+		t.Error("Expected the replayed DB to match the state after the recording")
+	}
+}